@@ -221,7 +221,13 @@ func WriteConfig(cfgFile string, cfg Configuration) error {
 
 // Decode a map[] into a structure
 func Decode(in, out interface{}) {
-	d, _ := mapstructure.NewDecoder(&mapstructure.DecoderConfig{Result: out})
+	DecodeWithHook(in, out, nil)
+}
+
+// DecodeWithHook decodes a map[] into a structure, using the decode
+// hook to convert values
+func DecodeWithHook(in, out interface{}, hook mapstructure.DecodeHookFunc) {
+	d, _ := mapstructure.NewDecoder(&mapstructure.DecoderConfig{Result: out, DecodeHook: hook})
 	err := d.Decode(in)
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Error decoding configuration: %s", err))
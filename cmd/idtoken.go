@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(IDTokenCmd)
+	tokenFlags(IDTokenCmd)
+}
+
+// IDTokenCmd is the took idtoken command
+var IDTokenCmd = &cobra.Command{
+	Use: `idtoken [flags] config [username]
+
+Get an ID token for the configuration "config" for "username".`,
+	Short: "Get an ID token",
+	Long:  `Get an ID token for a config, renew if necessary`,
+	Args:  cobra.RangeArgs(1, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		runToken(args, true)
+	}}
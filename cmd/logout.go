@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bserdar/took/cfg"
+	"github.com/bserdar/took/proto"
+)
+
+var logoutAll bool
+var logoutEndSession bool
+
+func init() {
+	RootCmd.AddCommand(LogoutCmd)
+	LogoutCmd.Flags().BoolVarP(&logoutAll, "all", "a", false, "Log out all users of the configuration")
+	LogoutCmd.Flags().BoolVar(&logoutEndSession, "end-session", false, "Also end the user session at the server")
+}
+
+// LogoutCmd is the took logout command
+var LogoutCmd = &cobra.Command{
+	Use: `logout [flags] config [username]
+
+Revoke and remove the tokens of the configuration "config" for "username".`,
+	Short: "Revoke tokens",
+	Long:  `Revoke the tokens of a user, or all users, at the server, and remove them`,
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		InitConfig()
+		cfg.DecryptUserConfig(cfg.UserCfgFile)
+		request := proto.LogoutRequest{All: logoutAll, EndSession: logoutEndSession}
+		if len(args) > 1 {
+			if logoutAll {
+				fmt.Println("Give either a username or --all")
+				os.Exit(1)
+			}
+			request.Username = args[1]
+		}
+		if err := proto.LogoutRemote(args[0], request); err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(1)
+		}
+		WriteUserConfig()
+	}}
@@ -3,8 +3,8 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/bserdar/took/cfg"
@@ -15,17 +15,30 @@ var forceNew bool
 var forceRenew bool
 var writeHeader bool
 var userName string
+var minValid time.Duration
+var scopes []string
+var resource string
+var audience string
 
 var insecureTLS bool
 
 func init() {
 	RootCmd.AddCommand(TokenCmd)
-	TokenCmd.Flags().BoolVarP(&forceNew, "force-new", "f", false, "Force new token")
-	TokenCmd.Flags().BoolVarP(&forceRenew, "renew", "r", false, "Force token renewal")
+	tokenFlags(TokenCmd)
+}
+
+// tokenFlags adds the token options to a command getting tokens
+func tokenFlags(c *cobra.Command) {
+	c.Flags().BoolVarP(&forceNew, "force-new", "f", false, "Force new token")
+	c.Flags().BoolVarP(&forceRenew, "renew", "r", false, "Force token renewal")
 	if cfg.InsecureAllowed() {
-		TokenCmd.Flags().BoolVarP(&proto.InsecureTLS, "insecure", "k", false, "Insecure TLS (do not validate certificates)")
+		c.Flags().BoolVarP(&proto.InsecureTLS, "insecure", "k", false, "Insecure TLS (do not validate certificates)")
 	}
-	TokenCmd.Flags().BoolVarP(&writeHeader, "header", "e", false, "Write HTTP header, Authorization: Bearer <token>")
+	c.Flags().BoolVarP(&writeHeader, "header", "e", false, "Write HTTP header, Authorization: Bearer <token>")
+	c.Flags().StringSliceVar(&scopes, "scope", nil, "Get a token with these scopes instead of the configured scopes (--scope a,b)")
+	c.Flags().StringVar(&resource, "resource", "", "Get a token for this resource URI (RFC 8707)")
+	c.Flags().StringVar(&audience, "audience", "", "Get a token for this audience")
+	c.Flags().DurationVar(&minValid, "min-valid", 0, "Minimum duration the token must remain valid, refresh or authenticate again if necessary (e.g. 10m)")
 }
 
 // TokenCmd is the took token command
@@ -37,65 +50,38 @@ Get a token for the configuration "config" for "username".`,
 	Long:  `Get a token for a config, renew if necessary`,
 	Args:  cobra.RangeArgs(1, 3),
 	Run: func(cmd *cobra.Command, args []string) {
-		InitConfig()
-		cfg.DecryptUserConfig(cfg.UserCfgFile)
-		userRemote, uok := cfg.UserCfg.Remotes[args[0]]
-		commonRemote, cok := cfg.CommonCfg.Remotes[args[0]]
-		if !uok && !cok {
-			log.Fatalf("Cannot find %s\n", args[0])
-		}
-		t := userRemote.Type
-		if len(t) == 0 {
-			t = commonRemote.Type
-		}
-		if len(t) == 0 {
-			log.Fatalf("Invalid configuration: no type for %s", args[0])
-		}
-		protocol := proto.Get(t)
-		if protocol == nil {
-			fmt.Printf("Cannot find protocol %s\n", t)
-			os.Exit(1)
-		}
-		protocol.SetCfg(userRemote, commonRemote)
-		// userCfg := protocol.GetConfigInstance()
-		// defaults := protocol.GetConfigDefaultsInstance()
-		// if uok {
-		// 	cfg.Decode(userRemote.Configuration, userCfg)
-		// 	log.Debugf("User cfg: %v", userCfg)
-		// }
-		// if cok {
-		// 	cfg.Decode(commonRemote.Configuration, defaults)
-		// 	log.Debugf("Defaults: %v", defaults)
-		// }
-		// data := protocol.GetDataInstance()
-		// if uok {
-		// 	cfg.Decode(userRemote.Data, data)
-		// }
-		opt := proto.UseDefault
-		if forceNew {
-			opt = proto.UseReAuth
-		} else if forceRenew {
-			opt = proto.UseRefresh
-		}
-		out := proto.OutputToken
-		if writeHeader {
-			out = proto.OutputHeader
-		}
-		userName := ""
-		password := ""
-		if len(args) > 1 {
-			userName = args[1]
-		}
-		if len(args) > 2 {
-			password = args[2]
-		}
-		s, data, err := protocol.GetToken(proto.TokenRequest{Refresh: opt, Out: out, Username: userName, Password: password})
-		if err != nil {
-			fmt.Printf("%s\n", err)
-			os.Exit(1)
-		}
-		fmt.Println(s)
-		cfg.UserCfg.Remotes[args[0]] = cfg.Remote{Type: userRemote.Type, Configuration: userRemote.Configuration,
-			Data: data}
-		WriteUserConfig()
+		runToken(args, false)
 	}}
+
+// runToken gets the access token, or the ID token, for the
+// configuration and user given in args, and prints it
+func runToken(args []string, idToken bool) {
+	InitConfig()
+	cfg.DecryptUserConfig(cfg.UserCfgFile)
+	opt := proto.UseDefault
+	if forceNew {
+		opt = proto.UseReAuth
+	} else if forceRenew {
+		opt = proto.UseRefresh
+	}
+	out := proto.OutputToken
+	if writeHeader {
+		out = proto.OutputHeader
+	}
+	userName := ""
+	password := ""
+	if len(args) > 1 {
+		userName = args[1]
+	}
+	if len(args) > 2 {
+		password = args[2]
+	}
+	s, err := proto.GetRemoteToken(args[0], proto.TokenRequest{Refresh: opt, Out: out, Username: userName, Password: password, MinValid: minValid, IDToken: idToken, Scopes: scopes,
+		Resource: resource, Audience: audience})
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(s)
+	WriteUserConfig()
+}
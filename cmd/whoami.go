@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bserdar/took/cfg"
+	"github.com/bserdar/took/proto"
+)
+
+var whoamiJSON bool
+
+func init() {
+	RootCmd.AddCommand(WhoamiCmd)
+	WhoamiCmd.Flags().BoolVarP(&whoamiJSON, "json", "j", false, "Print the claims as JSON")
+	WhoamiCmd.Flags().BoolVarP(&forceRenew, "renew", "r", false, "Force token renewal")
+	WhoamiCmd.Flags().BoolVarP(&forceNew, "force-new", "f", false, "Force new token")
+}
+
+// WhoamiCmd is the took whoami command
+var WhoamiCmd = &cobra.Command{
+	Use: `whoami [flags] config [username]
+
+Print the user claims for the configuration "config" for "username".`,
+	Short: "Print user information",
+	Long:  `Get a token for a config, renew if necessary, and print the user claims returned by the server`,
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		InitConfig()
+		cfg.DecryptUserConfig(cfg.UserCfgFile)
+		opt := proto.UseDefault
+		if forceNew {
+			opt = proto.UseReAuth
+		} else if forceRenew {
+			opt = proto.UseRefresh
+		}
+		userName := ""
+		if len(args) > 1 {
+			userName = args[1]
+		}
+		claims, err := proto.GetRemoteUserInfo(args[0], proto.TokenRequest{Refresh: opt, Username: userName})
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(1)
+		}
+		WriteUserConfig()
+		if whoamiJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(claims)
+			return
+		}
+		printClaims(claims)
+	}}
+
+// printClaims prints the claims as a table sorted by claim name
+func printClaims(claims map[string]interface{}) {
+	keys := make([]string, 0, len(claims))
+	for k := range claims {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, k := range keys {
+		value, ok := claims[k].(string)
+		if !ok {
+			data, _ := json.Marshal(claims[k])
+			value = string(data)
+		}
+		fmt.Fprintf(w, "%s\t%s\n", k, value)
+	}
+	w.Flush()
+}
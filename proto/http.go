@@ -2,15 +2,25 @@ package proto
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 
+	homedir "github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
 )
 
 // InsecureTLS set to true means TLS calls won't check certs
 var InsecureTLS = false
 
+// ClientCertificates are presented to servers requesting TLS client authentication
+var ClientCertificates []tls.Certificate
+
+// RootCAs, if non-nil, is used instead of the system roots to validate server certificates
+var RootCAs *x509.CertPool
+
 // GetHTTPClient is initializes to DefaultGetHTTPClient
 var GetHTTPClient = DefaultGetHTTPClient
 
@@ -22,14 +32,54 @@ var HTTPPostForm = DefaultHTTPPostForm
 
 // DefaultGetHTTPClient returns an HTTP client instance based on configuration
 func DefaultGetHTTPClient() *http.Client {
-	if InsecureTLS {
+	if InsecureTLS || len(ClientCertificates) > 0 || RootCAs != nil {
 		return &http.Client{
 			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: InsecureTLS,
+					Certificates: ClientCertificates,
+					RootCAs:      RootCAs}}}
 	}
 	return &http.Client{}
 }
 
+// LoadClientCertificate loads the PEM encoded client certificate and
+// key used for TLS client authentication
+func LoadClientCertificate(certFile, keyFile string) error {
+	certFile, err := homedir.Expand(certFile)
+	if err != nil {
+		return err
+	}
+	keyFile, err = homedir.Expand(keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("Cannot load client certificate: %s", err)
+	}
+	log.Debugf("Loaded client certificate %s", certFile)
+	ClientCertificates = []tls.Certificate{cert}
+	return nil
+}
+
+// LoadCABundle loads the PEM encoded CA certificates used to validate server certificates
+func LoadCABundle(file string) error {
+	file, err := homedir.Expand(file)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("No certificates in %s", file)
+	}
+	RootCAs = pool
+	return nil
+}
+
 // DefaultHTTPGet executes a GET using the HTTP client obtained from GetHTTPClient
 func DefaultHTTPGet(url string) (*http.Response, error) {
 	return GetHTTPClient().Get(url)
@@ -0,0 +1,124 @@
+package oidc
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+
+	"github.com/bserdar/took/cfg"
+)
+
+// authCodeFlow runs the authorization code flow, or the implicit or
+// hybrid flow if the configured response type says so. The
+// authorization response is obtained by submitting the login form if
+// there is one, or using a loopback listener if the callback URL is a
+// loopback URL, or by asking the user to copy/paste the redirected
+// URL. The nonce and the target are sent in the authorization request
+func (p *Protocol) authCodeFlow(config Config, serverData ServerData, auth ClientAuth, scopes []string, target Target, userName, password, nonce string) (oauth2.Token, error) {
+	types, err := responseTypes(config.ResponseType)
+	if err != nil {
+		return oauth2.Token{}, err
+	}
+	conf := &oauth2.Config{
+		ClientID:    config.ClientID,
+		Scopes:      scopes,
+		RedirectURL: config.CallbackURL,
+		Endpoint: oauth2.Endpoint{
+			AuthURL: p.GetAuthURL(serverData)}}
+
+	// Generate a crytographically secure random token for the state.
+	state, err := randomString(stateRandomLength)
+	if err != nil {
+		return oauth2.Token{}, err
+	}
+
+	authOpts := []oauth2.AuthCodeOption{oauth2.AccessTypeOnline, oauth2.SetAuthURLParam("nonce", nonce)}
+	authOpts = append(authOpts, target.authOptions()...)
+	if len(config.ResponseMode) > 0 {
+		authOpts = append(authOpts, oauth2.SetAuthURLParam("response_mode", config.ResponseMode))
+	}
+	if len(config.ResponseType) > 0 {
+		authOpts = append(authOpts, oauth2.SetAuthURLParam("response_type", config.ResponseType))
+	}
+	var verifier string
+	pkce, err := usePKCE(config.PKCE, serverData)
+	if err != nil {
+		return oauth2.Token{}, err
+	}
+	if pkce {
+		verifier, err = randomString(pkceVerifierLength)
+		if err != nil {
+			return oauth2.Token{}, err
+		}
+		log.Debug("Using PKCE")
+		authOpts = append(authOpts, oauth2.SetAuthURLParam("code_challenge", pkceChallenge(verifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", pkceMethodS256))
+	}
+	authURL := conf.AuthCodeURL(state, authOpts...)
+	var redirectedURL *url.URL
+	if len(config.Login) > 0 || config.Form != nil {
+		// Reuse the login session with the server, if there is one
+		jar, err := newSessionJar(p.Tokens.sessionCookies(userName), time.Now())
+		if err != nil {
+			return oauth2.Token{}, err
+		}
+		if len(config.Login) > 0 {
+			redirectedURL, err = RunLoginScript(config.Login, authURL, config.CallbackURL, userName, password, jar)
+			if err != nil {
+				fmt.Printf("Authentication failed: %s\n", err)
+			}
+		} else {
+			redirectedURL = FormAuth(*config.Form, authURL, config.CallbackURL, userName, password, jar)
+			if redirectedURL == nil {
+				fmt.Printf("Authentication failed\n")
+			}
+		}
+		p.Tokens.setSession(userName, jar.stored(time.Now()))
+	}
+	if redirectedURL == nil && isLoopbackURL(config.CallbackURL) {
+		redirectedURL, err = LoopbackAuth(authURL, config.CallbackURL, userName)
+		if err != nil {
+			return oauth2.Token{}, err
+		}
+	}
+	var response url.Values
+	// bareCode is set if the user pasted only the authorization code
+	bareCode := false
+	if redirectedURL != nil {
+		response = authResponseValues(redirectedURL)
+	} else {
+		in := cfg.Ask(fmt.Sprintf(`Go to this URL to authenticate %s: %s
+After authentication, copy/paste the URL, or the authorization code here:`, userName, authURL))
+		response, bareCode, err = parseAuthResponse(in)
+		if err != nil {
+			return oauth2.Token{}, err
+		}
+	}
+	if e := response.Get("error"); len(e) > 0 {
+		return oauth2.Token{}, fmt.Errorf("Authentication error: %s %s", e, response.Get("error_description"))
+	}
+	if !bareCode && state != response.Get("state") {
+		return oauth2.Token{}, fmt.Errorf("Invalid state")
+	}
+	if !types[responseTypeCode] {
+		// Implicit flow, tokens are in the response
+		if len(response.Get("access_token")) == 0 && len(response.Get("id_token")) == 0 {
+			return oauth2.Token{}, fmt.Errorf("No tokens in the authorization response")
+		}
+		return implicitToken(response, time.Now()), nil
+	}
+	code := response.Get("code")
+	if idToken := response.Get("id_token"); len(idToken) > 0 {
+		// Hybrid flow, the ID token must be valid for the code
+		if err := VerifyIDToken(idToken, serverData, auth, nonce, response.Get("access_token"), time.Now()); err != nil {
+			return oauth2.Token{}, fmt.Errorf("Invalid ID token: %s", err)
+		}
+		if err := verifyCodeHash(idToken, code); err != nil {
+			return oauth2.Token{}, err
+		}
+	}
+	return AuthCodeToken(auth, code, config.CallbackURL, verifier, target, p.GetTokenURL(serverData))
+}
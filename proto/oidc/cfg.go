@@ -1,5 +1,11 @@
 package oidc
 
+import (
+	"reflect"
+
+	"github.com/bserdar/took/cfg"
+)
+
 // ServerProfile defines an OIDC auth server
 type ServerProfile struct {
 	URL              string          `yaml:"url,omitempty" mapstructure:"url,omitempty"`
@@ -9,15 +15,78 @@ type ServerProfile struct {
 	Insecure         bool
 	PasswordGrant    *bool    `yaml:"passwordgrant,omitempty"`
 	RefreshOnly      *bool    `yaml:"refreshonly,omitempty"`
+	DeviceGrant      *bool    `yaml:"devicegrant,omitempty"`
 	AdditionalScopes []string `yaml:"additionalscopes,omitempty"`
+	// ResponseMode is passed to the authorization endpoint if
+	// nonempty. Use form_post to receive the authorization response
+	// as a POST to a loopback callback URL
+	ResponseMode string `yaml:"responsemode,omitempty" mapstructure:"responsemode,omitempty"`
+	// ResponseType is the response type of authorization requests:
+	// code (default), the implicit flow response types id_token or
+	// "id_token token", or the hybrid flow response types "code
+	// id_token", "code token", or "code id_token token"
+	ResponseType string `yaml:"responsetype,omitempty" mapstructure:"responsetype,omitempty"`
+	// PKCE is one of allow, force, or disable. If allow or empty,
+	// PKCE is used if the server supports S256
+	PKCE string `yaml:"pkce,omitempty" mapstructure:"pkce,omitempty"`
+	// ClientCredentials uses the client credentials grant. Tokens
+	// are stored without a username
+	ClientCredentials *bool `yaml:"clientcredentials,omitempty"`
+	// CABundle is a PEM file containing the CA certificates to
+	// validate the server certificate. If empty, system roots are used
+	CABundle string `yaml:"cabundle,omitempty" mapstructure:"cabundle,omitempty"`
+	// Introspect validates all tokens using the introspection
+	// endpoint. Otherwise JWT tokens are validated locally
+	Introspect bool `yaml:"introspect,omitempty" mapstructure:"introspect,omitempty"`
+	// DiscoveryTTL is how long the discovery document is cached, a
+	// duration like 10m or 24h. Defaults to 1h
+	DiscoveryTTL string `yaml:"discoveryttl,omitempty" mapstructure:"discoveryttl,omitempty"`
+	// RefreshSkew is how long before its expiration a token is
+	// refreshed, a duration like 1m. Defaults to 30s
+	RefreshSkew string `yaml:"refreshskew,omitempty" mapstructure:"refreshskew,omitempty"`
+	// Resource and Audience are the default target service of the
+	// tokens. Resource is a URI (RFC 8707), audience is a logical name
+	Resource string `yaml:"resource,omitempty" mapstructure:"resource,omitempty"`
+	Audience string `yaml:"audience,omitempty" mapstructure:"audience,omitempty"`
+	// Endpoints relative to the server URL, or absolute URLs. These
+	// override the discovered endpoints
+	IntrospectionAPI string `yaml:"introspectionapi,omitempty" mapstructure:"introspectionapi,omitempty"`
+	RevocationAPI    string `yaml:"revocationapi,omitempty" mapstructure:"revocationapi,omitempty"`
+	DeviceAPI        string `yaml:"deviceapi,omitempty" mapstructure:"deviceapi,omitempty"`
+	UserInfoAPI      string `yaml:"userinfoapi,omitempty" mapstructure:"userinfoapi,omitempty"`
+	EndSessionAPI    string `yaml:"endsessionapi,omitempty" mapstructure:"endsessionapi,omitempty"`
+	JWKSAPI          string `yaml:"jwksapi,omitempty" mapstructure:"jwksapi,omitempty"`
+	// NoDiscovery disables server metadata discovery. All endpoints
+	// must be given in the configuration
+	NoDiscovery bool `yaml:"nodiscovery,omitempty" mapstructure:"nodiscovery,omitempty"`
+	// Login is a login script for the server login pages. If
+	// nonempty, it is used instead of Form
+	Login []LoginStep `yaml:"login,omitempty" mapstructure:"login,omitempty"`
 }
 
 // Merge sets any unset field in s from in, and returns the merged copy
 func (s ServerProfile) Merge(in ServerProfile) ServerProfile {
 	ret := ServerProfile{URL: wdef(s.URL, in.URL),
-		TokenAPI: wdef(s.TokenAPI, in.TokenAPI),
-		AuthAPI:  wdef(s.AuthAPI, in.AuthAPI)}
+		TokenAPI:     wdef(s.TokenAPI, in.TokenAPI),
+		AuthAPI:      wdef(s.AuthAPI, in.AuthAPI),
+		ResponseMode: wdef(s.ResponseMode, in.ResponseMode),
+		ResponseType: wdef(s.ResponseType, in.ResponseType),
+		PKCE:         wdef(s.PKCE, in.PKCE),
+		CABundle:     wdef(s.CABundle, in.CABundle),
+		DiscoveryTTL: wdef(s.DiscoveryTTL, in.DiscoveryTTL),
+		RefreshSkew:  wdef(s.RefreshSkew, in.RefreshSkew),
+		Resource:     wdef(s.Resource, in.Resource),
+		Audience:     wdef(s.Audience, in.Audience),
+
+		IntrospectionAPI: wdef(s.IntrospectionAPI, in.IntrospectionAPI),
+		RevocationAPI:    wdef(s.RevocationAPI, in.RevocationAPI),
+		DeviceAPI:        wdef(s.DeviceAPI, in.DeviceAPI),
+		UserInfoAPI:      wdef(s.UserInfoAPI, in.UserInfoAPI),
+		EndSessionAPI:    wdef(s.EndSessionAPI, in.EndSessionAPI),
+		JWKSAPI:          wdef(s.JWKSAPI, in.JWKSAPI)}
 	ret.Insecure = s.Insecure || in.Insecure
+	ret.Introspect = s.Introspect || in.Introspect
+	ret.NoDiscovery = s.NoDiscovery || in.NoDiscovery
 	ret.PasswordGrant = s.PasswordGrant
 	if ret.PasswordGrant == nil {
 		ret.PasswordGrant = in.PasswordGrant
@@ -26,10 +95,22 @@ func (s ServerProfile) Merge(in ServerProfile) ServerProfile {
 	if ret.RefreshOnly == nil {
 		ret.RefreshOnly = in.RefreshOnly
 	}
+	ret.DeviceGrant = s.DeviceGrant
+	if ret.DeviceGrant == nil {
+		ret.DeviceGrant = in.DeviceGrant
+	}
+	ret.ClientCredentials = s.ClientCredentials
+	if ret.ClientCredentials == nil {
+		ret.ClientCredentials = in.ClientCredentials
+	}
 	ret.Form = s.Form
 	if ret.Form == nil {
 		ret.Form = in.Form
 	}
+	ret.Login = s.Login
+	if ret.Login == nil {
+		ret.Login = in.Login
+	}
 	ret.AdditionalScopes = append(s.AdditionalScopes, in.AdditionalScopes...)
 
 	return ret
@@ -42,13 +123,37 @@ type Config struct {
 	ClientID      string `yaml:"clientid" mapstructure:"clientid"`
 	ClientSecret  string
 	CallbackURL   string `yaml:"callbackurl,omitempty" mapstructure:"callbackurl,omitempty"`
+	// TokenEndpointAuthMethod is the client authentication method:
+	// client_secret_basic, client_secret_post, client_secret_jwt,
+	// private_key_jwt, tls_client_auth, self_signed_tls_client_auth,
+	// or none
+	TokenEndpointAuthMethod string `yaml:"tokenendpointauthmethod,omitempty" mapstructure:"tokenendpointauthmethod,omitempty"`
+	// ClientKeyFile is the PEM private key file used to sign private_key_jwt assertions
+	ClientKeyFile string `yaml:"clientkeyfile,omitempty" mapstructure:"clientkeyfile,omitempty"`
+	// ClientKeyID is the key id for private_key_jwt assertions
+	ClientKeyID string `yaml:"clientkeyid,omitempty" mapstructure:"clientkeyid,omitempty"`
+	// ClientCert and ClientCertKey are the PEM certificate and key
+	// files for TLS client authentication
+	ClientCert    string `yaml:"clientcert,omitempty" mapstructure:"clientcert,omitempty"`
+	ClientCertKey string `yaml:"clientcertkey,omitempty" mapstructure:"clientcertkey,omitempty"`
+	// If non-nil, tokens are obtained by exchanging the token of another remote
+	TokenExchange *TokenExchangeConfig `yaml:"tokenexchange,omitempty" mapstructure:"tokenexchange,omitempty"`
 }
 
 // Merge sets the unset fields of c from defaults
 func (c Config) Merge(defaults Config) Config {
 	ret := Config{ClientID: wdef(c.ClientID, defaults.ClientID),
-		ClientSecret: wdef(c.ClientSecret, defaults.ClientSecret),
-		CallbackURL:  wdef(c.CallbackURL, defaults.CallbackURL)}
+		ClientSecret:            wdef(c.ClientSecret, defaults.ClientSecret),
+		CallbackURL:             wdef(c.CallbackURL, defaults.CallbackURL),
+		TokenEndpointAuthMethod: wdef(c.TokenEndpointAuthMethod, defaults.TokenEndpointAuthMethod),
+		ClientKeyFile:           wdef(c.ClientKeyFile, defaults.ClientKeyFile),
+		ClientKeyID:             wdef(c.ClientKeyID, defaults.ClientKeyID),
+		ClientCert:              wdef(c.ClientCert, defaults.ClientCert),
+		ClientCertKey:           wdef(c.ClientCertKey, defaults.ClientCertKey)}
+	ret.TokenExchange = c.TokenExchange
+	if ret.TokenExchange == nil {
+		ret.TokenExchange = defaults.TokenExchange
+	}
 	ret.ServerProfile = c.ServerProfile.Merge(defaults.ServerProfile)
 	return ret
 }
@@ -58,3 +163,17 @@ func wdef(s, def string) string {
 	}
 	return def
 }
+
+// decodeConfig decodes a configuration map into out. The form can be
+// given as "auto" instead of a form configuration
+func decodeConfig(in, out interface{}) {
+	cfg.DecodeWithHook(in, out, formDecodeHook)
+}
+
+// formDecodeHook decodes the string "auto" as an automatically detected form
+func formDecodeHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() == reflect.String && to == reflect.TypeOf(HTMLFormConfig{}) && data.(string) == FormAuto {
+		return HTMLFormConfig{Auto: true}, nil
+	}
+	return data, nil
+}
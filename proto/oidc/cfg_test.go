@@ -33,3 +33,25 @@ func TestMerge(t *testing.T) {
 		t.Errorf("Got %+v", x)
 	}
 }
+
+func TestDecodeConfig_FormAuto(t *testing.T) {
+	var in interface{}
+	if err := yml.Unmarshal([]byte("url: http://server\nclientid: id\nform: auto\n"), &in); err != nil {
+		t.Fatal(err)
+	}
+	var c Config
+	decodeConfig(in, &c)
+	if c.Form == nil || !c.Form.Auto || c.ClientID != "id" {
+		t.Errorf("Wrong config: %+v", c)
+	}
+
+	in = nil
+	if err := yml.Unmarshal([]byte("form:\n  id: login\n  usernameField: user\n"), &in); err != nil {
+		t.Fatal(err)
+	}
+	c = Config{}
+	decodeConfig(in, &c)
+	if c.Form == nil || c.Form.Auto || c.Form.ID != "login" || c.Form.UsernameField != "user" {
+		t.Errorf("Wrong config: %+v", c.Form)
+	}
+}
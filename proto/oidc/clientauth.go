@@ -0,0 +1,218 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	jose "gopkg.in/square/go-jose.v2"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/bserdar/took/proto"
+)
+
+// Client authentication methods
+const (
+	ClientSecretBasic = "client_secret_basic"
+	ClientSecretPost  = "client_secret_post"
+	ClientSecretJWT   = "client_secret_jwt"
+	PrivateKeyJWT     = "private_key_jwt"
+	ClientAuthNone    = "none"
+	// TLS client authentication (RFC 8705). The client certificate
+	// authenticates the client, only the client id is sent
+	TLSClientAuth           = "tls_client_auth"
+	SelfSignedTLSClientAuth = "self_signed_tls_client_auth"
+)
+
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionLifetime is the validity period of client assertion JWTs
+const clientAssertionLifetime = 5 * time.Minute
+
+// ClientAuth contains the client credentials and how to send them to the auth server
+type ClientAuth struct {
+	ClientID     string
+	ClientSecret string
+	// One of the client authentication methods. If empty,
+	// client_secret_basic is used if there is a client secret,
+	// otherwise none
+	Method string
+	// KeyFile is the PEM private key file for private_key_jwt
+	KeyFile string
+	// KeyID is the optional kid header of the client assertion
+	KeyID string
+	// Audience is the audience of the client assertion, the token endpoint
+	Audience string
+}
+
+// clientAuth returns the client authentication for the merged configuration
+func (p *Protocol) clientAuth(s ServerData) ClientAuth {
+	config := p.GetConfig()
+	return ClientAuth{ClientID: config.ClientID,
+		ClientSecret: config.ClientSecret,
+		Method:       config.TokenEndpointAuthMethod,
+		KeyFile:      config.ClientKeyFile,
+		KeyID:        config.ClientKeyID,
+		Audience:     p.GetTokenURL(s)}
+}
+
+func (c ClientAuth) method() string {
+	if len(c.Method) > 0 {
+		return c.Method
+	}
+	if len(c.ClientSecret) > 0 {
+		return ClientSecretBasic
+	}
+	return ClientAuthNone
+}
+
+// hasSharedSecret returns true if the client authenticates with a
+// client secret, which the server can also use to sign ID tokens
+func (c ClientAuth) hasSharedSecret() bool {
+	if len(c.ClientSecret) == 0 {
+		return false
+	}
+	switch c.method() {
+	case ClientSecretBasic, ClientSecretPost, ClientSecretJWT:
+		return true
+	}
+	return false
+}
+
+// Apply adds the client authentication to the request. The request
+// body is built from values
+func (c ClientAuth) Apply(req *http.Request, values url.Values) error {
+	switch c.method() {
+	case ClientSecretBasic:
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	case ClientSecretPost:
+		values.Set("client_id", c.ClientID)
+		values.Set("client_secret", c.ClientSecret)
+	case ClientSecretJWT, PrivateKeyJWT:
+		assertion, err := c.assertion()
+		if err != nil {
+			return err
+		}
+		values.Set("client_id", c.ClientID)
+		values.Set("client_assertion_type", clientAssertionType)
+		values.Set("client_assertion", assertion)
+	case ClientAuthNone, TLSClientAuth, SelfSignedTLSClientAuth:
+		values.Set("client_id", c.ClientID)
+	default:
+		return fmt.Errorf("Unknown client authentication method: %s", c.Method)
+	}
+	return nil
+}
+
+// PostForm posts values to the endpoint after adding client authentication
+func (c ClientAuth) PostForm(endpoint string, values url.Values) (*http.Response, error) {
+	if values == nil {
+		values = url.Values{}
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Apply(req, values); err != nil {
+		return nil, err
+	}
+	body := values.Encode()
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	log.Debugf("Post %s (%s)", endpoint, c.method())
+	return proto.GetHTTPClient().Do(req)
+}
+
+// assertion builds a signed client assertion JWT
+func (c ClientAuth) assertion() (string, error) {
+	var key jose.SigningKey
+	if c.method() == ClientSecretJWT {
+		key = jose.SigningKey{Algorithm: jose.HS256, Key: []byte(c.ClientSecret)}
+	} else {
+		k, alg, err := readPrivateKey(c.KeyFile)
+		if err != nil {
+			return "", err
+		}
+		key = jose.SigningKey{Algorithm: alg, Key: k}
+	}
+	opts := &jose.SignerOptions{}
+	opts.WithType("JWT")
+	if len(c.KeyID) > 0 {
+		opts.WithHeader("kid", c.KeyID)
+	}
+	signer, err := jose.NewSigner(key, opts)
+	if err != nil {
+		return "", err
+	}
+	jti, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.Claims{Issuer: c.ClientID,
+		Subject:  c.ClientID,
+		Audience: jwt.Audience{c.Audience},
+		ID:       jti,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(clientAssertionLifetime))}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// readPrivateKey reads an RSA or EC private key from a PEM file, and
+// returns the key with the signature algorithm to use
+func readPrivateKey(file string) (crypto.Signer, jose.SignatureAlgorithm, error) {
+	if len(file) == 0 {
+		return nil, "", fmt.Errorf("Client key file is required for %s", PrivateKeyJWT)
+	}
+	file, err := homedir.Expand(file)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, "", fmt.Errorf("No PEM data in %s", file)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("Cannot parse private key in %s: %s", file, err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return k, jose.ES256, nil
+		case elliptic.P384():
+			return k, jose.ES384, nil
+		case elliptic.P521():
+			return k, jose.ES512, nil
+		}
+	}
+	return nil, "", fmt.Errorf("Unsupported private key type in %s", file)
+}
@@ -0,0 +1,93 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestClientAuthApply(t *testing.T) {
+	for _, x := range []struct {
+		auth   ClientAuth
+		basic  bool
+		fields url.Values
+	}{
+		{ClientAuth{ClientID: "id", ClientSecret: "s"}, true, url.Values{}},
+		{ClientAuth{ClientID: "id"}, false, url.Values{"client_id": {"id"}}},
+		{ClientAuth{ClientID: "id", ClientSecret: "s", Method: ClientSecretPost}, false, url.Values{"client_id": {"id"}, "client_secret": {"s"}}},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, "http://token", nil)
+		values := url.Values{}
+		if err := x.auth.Apply(req, values); err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		id, secret, basic := req.BasicAuth()
+		if basic != x.basic || (basic && (id != "id" || secret != "s")) {
+			t.Errorf("Wrong basic auth for %+v: %s %s", x.auth, id, secret)
+		}
+		if values.Encode() != x.fields.Encode() {
+			t.Errorf("Wrong fields for %+v: %v", x.auth, values)
+		}
+	}
+	if err := (ClientAuth{Method: "x"}).Apply(&http.Request{}, url.Values{}); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestClientAuthPrivateKeyJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+
+	auth := ClientAuth{ClientID: "id", Method: PrivateKeyJWT, KeyFile: keyFile, KeyID: "k1", Audience: "http://token"}
+	values := url.Values{}
+	req, _ := http.NewRequest(http.MethodPost, "http://token", nil)
+	if err := auth.Apply(req, values); err != nil {
+		t.Fatal(err)
+	}
+	if values.Get("client_assertion_type") != clientAssertionType {
+		t.Errorf("Wrong assertion type: %v", values)
+	}
+	tok, err := jwt.ParseSigned(values.Get("client_assertion"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Headers[0].KeyID != "k1" {
+		t.Errorf("Wrong kid: %s", tok.Headers[0].KeyID)
+	}
+	var claims jwt.Claims
+	if err := tok.Claims(&key.PublicKey, &claims); err != nil {
+		t.Fatalf("Cannot verify assertion: %v", err)
+	}
+	if err := claims.Validate(jwt.Expected{Issuer: "id", Subject: "id", Audience: jwt.Audience{"http://token"}, Time: time.Now()}); err != nil {
+		t.Errorf("Invalid claims: %v", err)
+	}
+}
+
+func TestClientAuthSecretJWT(t *testing.T) {
+	auth := ClientAuth{ClientID: "id", ClientSecret: "0123456789abcdef0123456789abcdef", Method: ClientSecretJWT, Audience: "http://token"}
+	values := url.Values{}
+	if err := auth.Apply(&http.Request{Header: http.Header{}}, values); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := jwt.ParseSigned(values.Get("client_assertion"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims jwt.Claims
+	if err := tok.Claims([]byte(auth.ClientSecret), &claims); err != nil {
+		t.Errorf("Cannot verify assertion: %v", err)
+	}
+}
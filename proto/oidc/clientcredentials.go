@@ -0,0 +1,22 @@
+package oidc
+
+import (
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// ClientCredentialsToken gets a token for the client itself using
+// the client credentials grant
+func ClientCredentialsToken(auth ClientAuth, scopes []string, target Target, tokenURL string) (oauth2.Token, error) {
+	values := url.Values{}
+	values.Set("grant_type", "client_credentials")
+	if len(scopes) > 0 {
+		values.Set("scope", strings.Join(scopes, " "))
+	}
+	target.setValues(values)
+	log.Debugf("Client credentials %s", tokenURL)
+	return postTokenRequest(auth, tokenURL, values)
+}
@@ -1,10 +1,12 @@
 package oidc
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -14,11 +16,13 @@ import (
 )
 
 type oidcConnect struct {
-	Name   string
-	Cfg    Config
-	form   string
-	scopes string
-	flow   string
+	Name     string
+	Cfg      Config
+	form     string
+	scopes   string
+	flow     string
+	exchange TokenExchangeConfig
+	xscopes  string
 }
 
 var oidcCfg oidcConnect
@@ -42,13 +46,13 @@ var oidcConnectWizard = []proto.SetupStep{
 		oidcCfg.Cfg.CallbackURL = in
 		return nil
 	}, GetDefault: func(remoteCfg interface{}) string { return remoteCfg.(*Config).CallbackURL }},
-	{Prompt: "OIDC flow (auth - authorization code flow, pwd - password grant flow, refresh - refresh grant flow, leave empty to use server profile default):",
+	{Prompt: "OIDC flow (auth - authorization code flow, pwd - password grant flow, refresh - refresh grant flow, device - device authorization flow, client - client credentials flow, leave empty to use server profile default):",
 		Parse: func(in string) error {
 			in = strings.TrimSpace(in)
-			if in == "pwd" || in == "auth" || in == "refresh" || in == "" {
+			if in == "pwd" || in == "auth" || in == "refresh" || in == "device" || in == "client" || in == "" {
 				oidcCfg.flow = in
 			} else {
-				return fmt.Errorf("Invalid entry %s, enter auth, pwd,or leave empty", in)
+				return fmt.Errorf("Invalid entry %s, enter auth, pwd, refresh, device, client, or leave empty", in)
 			}
 			return nil
 		}}}
@@ -60,6 +64,9 @@ func init() {
 	//	})
 	cmd.AddCmd.AddCommand(oidcConnectCmd)
 	cmd.ModCmd.AddCommand(oidcConnectUpdateCmd)
+	cmd.RootCmd.AddCommand(discoveryCmd)
+	discoveryCmd.AddCommand(discoveryShowCmd)
+	discoveryCmd.AddCommand(discoveryRefreshCmd)
 
 	doFlags := func(cmd *cobra.Command) {
 		cmd.Flags().StringVarP(&oidcCfg.Name, "name", "n", "", "Name of the configuration (required)")
@@ -69,12 +76,37 @@ func init() {
 		cmd.MarkFlagRequired("clientId")
 		cmd.Flags().StringVarP(&oidcCfg.Cfg.ClientSecret, "secret", "s", "", "Client Secret")
 		cmd.Flags().StringVarP(&oidcCfg.Cfg.CallbackURL, "callback-url", "b", "", "Callback URL")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.TokenEndpointAuthMethod, "auth-method", "", "Client authentication method: client_secret_basic (default with a secret), client_secret_post, client_secret_jwt, private_key_jwt, tls_client_auth, self_signed_tls_client_auth, or none")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.ClientKeyFile, "client-key", "", "PEM private key file for private_key_jwt client authentication")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.ClientKeyID, "client-key-id", "", "Key ID for private_key_jwt client authentication")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.ClientCert, "client-cert", "", "PEM client certificate file for TLS client authentication")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.ClientCertKey, "client-cert-key", "", "PEM private key file of the client certificate")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.CABundle, "ca-bundle", "", "PEM file containing the CA certificates to validate the server certificate")
 		cmd.Flags().StringVarP(&oidcCfg.Cfg.Profile, "server", "e", "", "Server profile to use. Either a server profile or the server URL must be given")
 		cmd.Flags().StringVarP(&oidcCfg.Cfg.URL, "url", "u", "", "Server URL. Either a server profile or server URL must be given")
 		cmd.Flags().StringVarP(&oidcCfg.Cfg.TokenAPI, "token-api", "a", "", "Token API (defaults to protocol/openid-connect/token)")
 		cmd.Flags().StringVarP(&oidcCfg.Cfg.AuthAPI, "auth-api", "t", "", "Auth API (defaults to protocol/openid-connect/auth)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.IntrospectionAPI, "introspection-api", "", "Introspection API, relative to the server URL or absolute (defaults to the discovered endpoint)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.RevocationAPI, "revocation-api", "", "Revocation API, relative to the server URL or absolute (defaults to the discovered endpoint)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.DeviceAPI, "device-api", "", "Device authorization API, relative to the server URL or absolute (defaults to the discovered endpoint)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.UserInfoAPI, "userinfo-api", "", "Userinfo API, relative to the server URL or absolute (defaults to the discovered endpoint)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.EndSessionAPI, "end-session-api", "", "End session API, relative to the server URL or absolute (defaults to the discovered endpoint)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.JWKSAPI, "jwks-api", "", "JWKS URI, relative to the server URL or absolute (defaults to the discovered endpoint)")
+		cmd.Flags().BoolVar(&oidcCfg.Cfg.NoDiscovery, "no-discovery", false, "Do not retrieve server metadata, use the configured endpoints only")
 		cmd.Flags().StringVarP(&oidcCfg.scopes, "scopes", "o", "", "Additional scopes to request from server (-o scope1,scope2,scope3)")
-		cmd.Flags().StringVarP(&oidcCfg.flow, "flow", "f", "", "Use authorization code flow (auth), password grant flow (pwd), or refresh token flow (refresh)")
+		cmd.Flags().StringVarP(&oidcCfg.flow, "flow", "f", "", "Use authorization code flow (auth), password grant flow (pwd), refresh token flow (refresh), device authorization flow (device), or client credentials flow (client)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.ResponseMode, "response-mode", "", "Response mode for authorization requests (query, form_post)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.ResponseType, "response-type", "", "Response type for authorization requests (code, id_token, \"id_token token\", \"code id_token\", ...)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.PKCE, "pkce", "", "Use PKCE with authorization code flow: allow (if server supports it), force, or disable")
+		cmd.Flags().StringVar(&oidcCfg.exchange.Subject, "exchange-from", "", "Get tokens by exchanging the token of this remote configuration")
+		cmd.Flags().StringVar(&oidcCfg.exchange.SubjectUser, "exchange-user", "", "Username for the remote configuration given in --exchange-from")
+		cmd.Flags().StringVar(&oidcCfg.exchange.Audience, "exchange-audience", "", "Audience of the exchanged token")
+		cmd.Flags().StringVar(&oidcCfg.xscopes, "exchange-scopes", "", "Scopes of the exchanged token (--exchange-scopes scope1,scope2)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.DiscoveryTTL, "discovery-ttl", "", "How long to cache the server discovery document (default 1h)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.Resource, "resource", "", "Default resource URI of the tokens (RFC 8707)")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.Audience, "audience", "", "Default audience of the tokens")
+		cmd.Flags().StringVar(&oidcCfg.Cfg.RefreshSkew, "refresh-skew", "", "Refresh tokens this long before they expire (default 30s)")
+		cmd.Flags().BoolVar(&oidcCfg.Cfg.Introspect, "introspect", false, "Validate tokens using the introspection endpoint instead of validating JWTs locally")
 		if cfg.InsecureAllowed() {
 			cmd.Flags().BoolVarP(&oidcCfg.Cfg.Insecure, "insecure", "k", false, "Do not validate server certificates")
 		}
@@ -90,7 +122,8 @@ func init() {
         "value": <default value, omit field if none>
       }
     ]
-  }`)
+  }
+Use "auto" to detect the username and password fields of the login form`)
 	}
 
 	doFlags(oidcConnectCmd)
@@ -165,29 +198,33 @@ func parseOidc(c *cobra.Command) {
 			}
 		}
 	}
+	setFlow := func(passwordGrant, refreshOnly, deviceGrant, clientCredentials bool) {
+		oidcCfg.Cfg.PasswordGrant = &passwordGrant
+		oidcCfg.Cfg.RefreshOnly = &refreshOnly
+		oidcCfg.Cfg.DeviceGrant = &deviceGrant
+		oidcCfg.Cfg.ClientCredentials = &clientCredentials
+	}
 	switch oidcCfg.flow {
 	case "auth":
-		x := false
-		oidcCfg.Cfg.PasswordGrant = &x
-		oidcCfg.Cfg.RefreshOnly = &x
+		setFlow(false, false, false, false)
 	case "pwd":
-		x := true
-		y := false
-		oidcCfg.Cfg.PasswordGrant = &x
-		oidcCfg.Cfg.RefreshOnly = &y
+		setFlow(true, false, false, false)
 	case "refresh":
-		x := false
-		y := true
-		oidcCfg.Cfg.PasswordGrant = &x
-		oidcCfg.Cfg.RefreshOnly = &y
+		setFlow(false, true, false, false)
+	case "device":
+		setFlow(false, false, true, false)
+	case "client":
+		setFlow(false, false, false, true)
 	case "":
 		break
 	default:
-		log.Fatalf("Invalid flow: %s Use 'auth', 'pwd', or 'refresh'", oidcCfg.flow)
+		log.Fatalf("Invalid flow: %s Use 'auth', 'pwd', 'refresh', 'device', or 'client'", oidcCfg.flow)
 	}
 
 	var formCfg HTMLFormConfig
-	if len(oidcCfg.form) > 0 {
+	if oidcCfg.form == FormAuto {
+		oidcCfg.Cfg.Form = &HTMLFormConfig{Auto: true}
+	} else if len(oidcCfg.form) > 0 {
 		err := json.Unmarshal([]byte(oidcCfg.form), &formCfg)
 		if err != nil {
 			log.Fatal(err)
@@ -197,6 +234,12 @@ func parseOidc(c *cobra.Command) {
 	if len(oidcCfg.scopes) > 0 {
 		oidcCfg.Cfg.AdditionalScopes = strings.Split(oidcCfg.scopes, ",")
 	}
+	if len(oidcCfg.exchange.Subject) > 0 {
+		if len(oidcCfg.xscopes) > 0 {
+			oidcCfg.exchange.Scopes = strings.Split(oidcCfg.xscopes, ",")
+		}
+		oidcCfg.Cfg.TokenExchange = &oidcCfg.exchange
+	}
 	cfg.UserCfg.Remotes[oidcCfg.Name] = cfg.Remote{Type: "oidc-auth", Configuration: oidcCfg.Cfg}
 	cmd.WriteUserConfig()
 }
@@ -207,3 +250,82 @@ func (p *Protocol) InitSetupWizard(name string, profileName string, profile cfg.
 	oidcCfg.Cfg.Profile = profileName
 	return oidcConnectWizard, oidcConnectCmd
 }
+
+var discoveryCmd = &cobra.Command{
+	Use:   "discovery",
+	Short: "Inspect or refresh cached OIDC discovery documents",
+	Long:  `Inspect or refresh cached OIDC discovery documents`}
+
+var discoveryShowCmd = &cobra.Command{
+	Use:   "show config",
+	Short: "Show the cached discovery document of an oidc configuration",
+	Long:  `Show the cached discovery document of an oidc configuration`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(c *cobra.Command, args []string) {
+		config := discoveryConfig(args[0])
+		entry := ReadDiscoveryCache(config.URL)
+		if entry == nil {
+			fmt.Printf("No cached discovery document for %s\n", config.URL)
+			return
+		}
+		printDiscoveryEntry(*entry)
+	}}
+
+var discoveryRefreshCmd = &cobra.Command{
+	Use:   "refresh config",
+	Short: "Retrieve the discovery document of an oidc configuration again",
+	Long:  `Remove the cached discovery document of an oidc configuration, and retrieve it from the server`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(c *cobra.Command, args []string) {
+		config := discoveryConfig(args[0])
+		if config.NoDiscovery {
+			log.Fatalf("Discovery is disabled for %s", args[0])
+		}
+		if err := FlushDiscoveryCache(config.URL); err != nil {
+			log.Fatal(err)
+		}
+		ttl, err := discoveryTTL(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := RefreshServerData(config.URL, ttl); err != nil {
+			log.Fatal(err)
+		}
+		if entry := ReadDiscoveryCache(config.URL); entry != nil {
+			printDiscoveryEntry(*entry)
+		}
+	}}
+
+// discoveryConfig returns the merged configuration of the named
+// oidc remote, and sets up TLS for it
+func discoveryConfig(name string) Config {
+	cmd.InitConfig()
+	cfg.DecryptUserConfig(cfg.UserCfgFile)
+	protocol, _, err := proto.GetRemoteProtocol(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p, ok := protocol.(*Protocol)
+	if !ok {
+		log.Fatalf("%s is not an oidc configuration", name)
+	}
+	config := p.GetConfig()
+	if config.Insecure {
+		proto.InsecureTLS = true
+	}
+	if err := setupTLS(config); err != nil {
+		log.Fatal(err)
+	}
+	return config
+}
+
+func printDiscoveryEntry(entry DiscoveryCacheEntry) {
+	fmt.Printf("URL: %s\n", entry.URL)
+	fmt.Printf("Fetched: %s\n", time.Unix(entry.Fetched, 0).Format(time.RFC3339))
+	fmt.Printf("Expires: %s\n", time.Unix(entry.Expires, 0).Format(time.RFC3339))
+	var doc bytes.Buffer
+	if err := json.Indent(&doc, entry.Document, "", "  "); err != nil {
+		doc.Write(entry.Document)
+	}
+	fmt.Println(doc.String())
+}
@@ -0,0 +1,172 @@
+package oidc
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionCookie is a cookie set by the server during form
+// authentication. Session cookies are stored with the tokens, so the
+// login session with the server can be used to authenticate again
+// without asking credentials
+type SessionCookie struct {
+	// URL is the URL of the response that set the cookie
+	URL    string
+	Name   string
+	Value  string
+	Domain string
+	Path   string
+	// Expires is a unix time, or 0 if the cookie expires with the session
+	Expires  int64
+	Secure   bool
+	HTTPOnly bool
+}
+
+// LoginSession is the login session of a user with the server
+type LoginSession struct {
+	Username string
+	Cookies  []SessionCookie
+}
+
+// sessionJar is a cookie jar that keeps the cookies it receives, so
+// they can be stored
+type sessionJar struct {
+	jar     *cookiejar.Jar
+	cookies []SessionCookie
+}
+
+// newSessionJar returns a cookie jar containing the unexpired stored cookies
+func newSessionJar(stored []SessionCookie, now time.Time) (*sessionJar, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	ret := &sessionJar{jar: jar}
+	for _, c := range stored {
+		if c.expired(now) {
+			continue
+		}
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			log.Debugf("Invalid cookie URL %s: %s", c.URL, err)
+			continue
+		}
+		cookie := &http.Cookie{Name: c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HTTPOnly}
+		if c.Expires != 0 {
+			cookie.Expires = time.Unix(c.Expires, 0)
+		}
+		jar.SetCookies(u, []*http.Cookie{cookie})
+		ret.cookies = append(ret.cookies, c)
+	}
+	return ret, nil
+}
+
+func (c SessionCookie) expired(now time.Time) bool {
+	return c.Expires != 0 && c.Expires <= now.Unix()
+}
+
+// key returns the domain, path, and name of the cookie, which
+// identifies a cookie in the jar
+func (c SessionCookie) key() string {
+	domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+	cookiePath := c.Path
+	if u, err := url.Parse(c.URL); err == nil {
+		if len(domain) == 0 {
+			domain = u.Hostname()
+		}
+		if len(cookiePath) == 0 || cookiePath[0] != '/' {
+			cookiePath = path.Dir(u.EscapedPath())
+		}
+	}
+	return domain + ";" + cookiePath + ";" + c.Name
+}
+
+// SetCookies stores the cookies in the jar, and keeps them
+func (j *sessionJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+	now := time.Now()
+	for _, cookie := range cookies {
+		c := SessionCookie{URL: (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String(),
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Domain:   cookie.Domain,
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HTTPOnly: cookie.HttpOnly}
+		if cookie.MaxAge > 0 {
+			c.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second).Unix()
+		} else if cookie.MaxAge < 0 {
+			c.Expires = now.Unix()
+		} else if !cookie.Expires.IsZero() {
+			c.Expires = cookie.Expires.Unix()
+		}
+		key := c.key()
+		kept := j.cookies[:0]
+		for _, x := range j.cookies {
+			if x.key() != key {
+				kept = append(kept, x)
+			}
+		}
+		j.cookies = kept
+		if !c.expired(now) {
+			j.cookies = append(j.cookies, c)
+		}
+	}
+}
+
+// Cookies returns the cookies to send to u
+func (j *sessionJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// stored returns the cookies to store
+func (j *sessionJar) stored(now time.Time) []SessionCookie {
+	var ret []SessionCookie
+	for _, c := range j.cookies {
+		if !c.expired(now) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// sessionCookies returns the stored cookies of the login session of the user
+func (d Data) sessionCookies(username string) []SessionCookie {
+	for _, s := range d.Sessions {
+		if s.Username == username {
+			return s.Cookies
+		}
+	}
+	return nil
+}
+
+// setSession stores the cookies of the login session of the user. If
+// there are no cookies, the session is removed
+func (d *Data) setSession(username string, cookies []SessionCookie) {
+	d.removeSession(username)
+	if len(cookies) > 0 {
+		d.Sessions = append(d.Sessions, LoginSession{Username: username, Cookies: cookies})
+	}
+}
+
+// removeSession removes the login session of the user
+func (d *Data) removeSession(username string) {
+	var kept []LoginSession
+	for _, s := range d.Sessions {
+		if s.Username != username {
+			kept = append(kept, s)
+		}
+	}
+	d.Sessions = kept
+}
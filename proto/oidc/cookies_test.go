@@ -0,0 +1,89 @@
+package oidc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bserdar/took/cfg"
+)
+
+func TestSessionJar(t *testing.T) {
+	now := time.Now()
+	jar, err := newSessionJar([]SessionCookie{{URL: "https://sso.example.com/auth", Name: "old", Value: "x", Expires: now.Add(-time.Minute).Unix()},
+		{URL: "https://sso.example.com/auth", Name: "kept", Value: "k", Path: "/"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://sso.example.com/auth/login")
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "s1", Path: "/auth"},
+		{Name: "persistent", Value: "p1", Path: "/", MaxAge: 3600}})
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "s2", Path: "/auth"},
+		{Name: "kept", Value: "", Path: "/", MaxAge: -1}})
+	stored := jar.stored(now)
+	if len(stored) != 2 {
+		t.Fatalf("Wrong cookies: %+v", stored)
+	}
+	values := map[string]string{}
+	for _, c := range stored {
+		values[c.Name] = c.Value
+	}
+	if values["session"] != "s2" || values["persistent"] != "p1" {
+		t.Errorf("Wrong cookies: %+v", stored)
+	}
+
+	restored, err := newSessionJar(stored, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := restored.Cookies(u); len(c) != 2 {
+		t.Errorf("Wrong restored cookies: %v", c)
+	}
+}
+
+func TestFormAuth_Session(t *testing.T) {
+	config := HTMLFormConfig{PasswordField: "password", UsernameField: "username",
+		Fields: []FieldConfig{{Input: "username"},
+			{Input: "password", Prompt: "Password", Password: true}}}
+	asked := 0
+	cfg.AskPasswordWithPrompt = func(prompt string) string {
+		asked++
+		return "pass"
+	}
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, req *http.Request) {
+		if c, err := req.Cookie("SSO"); err == nil && c.Value == "alive" {
+			http.Redirect(w, req, "http://callback/?code=abc", http.StatusFound)
+			return
+		}
+		w.Write([]byte(`<html><body><form action="/login">
+<input type="text" name="username"/><input type="password" name="password"/>
+</form></body></html>`))
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, req *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "SSO", Value: "alive", Path: "/"})
+		http.Redirect(w, req, "http://callback/?code=abc", http.StatusFound)
+	})
+
+	var data Data
+	for i := 0; i < 2; i++ {
+		jar, err := newSessionJar(data.sessionCookies("user"), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u := FormAuth(config, server.URL+"/auth", "http://callback/", "user", "", jar); u == nil {
+			t.Fatalf("Authentication failed")
+		}
+		data.setSession("user", jar.stored(time.Now()))
+	}
+	if asked != 1 {
+		t.Errorf("Expected 1 password prompt, got %d", asked)
+	}
+	if len(data.Sessions) != 1 || len(data.sessionCookies("user")) != 1 || data.sessionCookies("other") != nil {
+		t.Errorf("Wrong sessions: %+v", data.Sessions)
+	}
+}
@@ -0,0 +1,106 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Default polling interval if the server does not specify one
+const defaultDeviceInterval = 5 * time.Second
+
+// deviceSleep is used to wait between polls
+var deviceSleep = time.Sleep
+
+// DeviceAuthResponse is the response of the device authorization endpoint
+type DeviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	// Some servers return verification_url instead of verification_uri
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// DeviceAuth starts a device authorization grant, prints the user
+// code and verification URI, and polls the token endpoint until the
+// user completes authentication
+func DeviceAuth(auth ClientAuth, scopes []string, target Target, deviceURL, tokenURL, userName string) (oauth2.Token, error) {
+	if len(deviceURL) == 0 {
+		return oauth2.Token{}, fmt.Errorf("Server does not support device authorization")
+	}
+	values := url.Values{}
+	values.Set("scope", strings.Join(scopes, " "))
+	target.setValues(values)
+	resp, err := auth.PostForm(deviceURL, values)
+	if err != nil {
+		return oauth2.Token{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		tokenErr := TokenError{}
+		json.NewDecoder(resp.Body).Decode(&tokenErr)
+		tokenErr.Status = resp.Status
+		return oauth2.Token{}, tokenErr
+	}
+	var d DeviceAuthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return oauth2.Token{}, err
+	}
+	log.Debugf("Device authorization: %+v", d)
+	verificationURI := d.VerificationURI
+	if len(verificationURI) == 0 {
+		verificationURI = d.VerificationURL
+	}
+	if len(d.VerificationURIComplete) > 0 {
+		fmt.Printf("To authenticate %s, go to %s\nor go to %s and enter the code %s\n", userName, d.VerificationURIComplete, verificationURI, d.UserCode)
+	} else {
+		fmt.Printf("To authenticate %s, go to %s and enter the code %s\n", userName, verificationURI, d.UserCode)
+	}
+
+	interval := defaultDeviceInterval
+	if d.Interval > 0 {
+		interval = time.Duration(d.Interval) * time.Second
+	}
+	var deadline time.Time
+	if d.ExpiresIn > 0 {
+		deadline = time.Now().Add(time.Duration(d.ExpiresIn) * time.Second)
+	}
+
+	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return oauth2.Token{}, fmt.Errorf("Device code expired")
+		}
+		deviceSleep(interval)
+		values := url.Values{}
+		values.Set("grant_type", deviceCodeGrantType)
+		values.Set("device_code", d.DeviceCode)
+		target.setValues(values)
+		t, err := postTokenRequest(auth, tokenURL, values)
+		if err == nil {
+			return t, nil
+		}
+		tokenErr, ok := err.(TokenError)
+		if !ok {
+			return oauth2.Token{}, err
+		}
+		switch tokenErr.Code {
+		case "authorization_pending":
+			log.Debug("Authorization pending")
+		case "slow_down":
+			interval += 5 * time.Second
+			log.Debugf("Slowing down, interval=%s", interval)
+		default:
+			return oauth2.Token{}, err
+		}
+	}
+}
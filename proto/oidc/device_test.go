@@ -0,0 +1,87 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bserdar/took/proto"
+)
+
+func TestGetToken_Device(t *testing.T) {
+	polls := 0
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"token_endpoint":"%s/token","device_authorization_endpoint":"%s/device"}`, server.URL, server.URL)
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("client_id") != "id" {
+			t.Errorf("Wrong client id: %v", req.Form)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"device_code":"dc","user_code":"UC","verification_uri":"%s/verify","expires_in":600,"interval":2}`, server.URL)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("grant_type") != deviceCodeGrantType || req.Form.Get("device_code") != "dc" {
+			t.Errorf("Wrong token request: %v", req.Form)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		polls++
+		switch polls {
+		case 1:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"authorization_pending"}`))
+		case 2:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"slow_down"}`))
+		default:
+			w.Write([]byte(`{"access_token":"a","token_type":"bearer","refresh_token":"r"}`))
+		}
+	})
+
+	var intervals []time.Duration
+	deviceSleep = func(d time.Duration) { intervals = append(intervals, d) }
+	defer func() { deviceSleep = time.Sleep }()
+
+	p := Protocol{}
+	tr := true
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL, DeviceGrant: &tr},
+		ClientID: "id"}
+
+	ret, _, err := p.GetToken(proto.TokenRequest{Username: "user"})
+	if err != nil {
+		t.Errorf("Cannot get token: %v", err)
+	}
+	if ret != "a" {
+		t.Errorf("Wrong token: %s", ret)
+	}
+	if len(intervals) != 3 || intervals[0] != 2*time.Second || intervals[2] != 7*time.Second {
+		t.Errorf("Wrong polling intervals: %v", intervals)
+	}
+}
+
+func TestDeviceAuth_Denied(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"device_code":"dc","user_code":"UC","verification_uri":"http://verify"}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"access_denied"}`))
+	})
+	deviceSleep = func(time.Duration) {}
+	defer func() { deviceSleep = time.Sleep }()
+
+	_, err := DeviceAuth(ClientAuth{ClientID: "id"}, []string{"openid"}, Target{}, server.URL+"/device", server.URL+"/token", "user")
+	if tokenErr, ok := err.(TokenError); !ok || tokenErr.Code != "access_denied" {
+		t.Errorf("Expected access_denied, got %v", err)
+	}
+}
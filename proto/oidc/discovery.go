@@ -0,0 +1,254 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bserdar/took/proto"
+)
+
+// DiscoveryCacheDir is the directory where discovery documents are
+// cached. If empty, discovery documents are not cached
+var DiscoveryCacheDir = "~/.took-cache/discovery"
+
+// DefaultDiscoveryTTL is the default lifetime of a cached discovery
+// document. The server can shorten it using Cache-Control or Expires
+// headers
+const DefaultDiscoveryTTL = time.Hour
+
+// DiscoveryCacheEntry is a cached discovery document
+type DiscoveryCacheEntry struct {
+	// Server is the server URL, or the cache key of a key set. URL
+	// is the URL of the document
+	Server string `json:"server"`
+	URL    string `json:"url"`
+	// Fetched and Expires are unix times
+	Fetched  int64           `json:"fetched"`
+	Expires  int64           `json:"expires"`
+	Document json.RawMessage `json:"document"`
+}
+
+// Fresh returns true if the entry is not expired at time now, and
+// it is not older than ttl
+func (e DiscoveryCacheEntry) Fresh(now time.Time, ttl time.Duration) bool {
+	return now.Unix() < e.Expires && now.Before(time.Unix(e.Fetched, 0).Add(ttl))
+}
+
+// discoveryURLs returns the URLs to look for the server metadata:
+// the OpenID Connect discovery document, and the OAuth 2.0
+// authorization server metadata (RFC 8414). The RFC 8414 well-known
+// suffix is inserted between the host and the path of the server URL
+func discoveryURLs(serverURL string) []string {
+	ret := []string{combine(serverURL, ".well-known/openid-configuration")}
+	u, err := url.Parse(serverURL)
+	if err == nil && len(strings.Trim(u.Path, "/")) > 0 {
+		u.Path = "/.well-known/oauth-authorization-server/" + strings.Trim(u.Path, "/")
+		ret = append(ret, u.String())
+	}
+	return append(ret, combine(serverURL, ".well-known/oauth-authorization-server"))
+}
+
+// discoveryCacheFile returns the cache file name for the server URL,
+// or empty string if caching is disabled
+func discoveryCacheFile(serverURL string) string {
+	if len(DiscoveryCacheDir) == 0 {
+		return ""
+	}
+	dir, err := homedir.Expand(DiscoveryCacheDir)
+	if err != nil {
+		log.Debugf("Cannot expand %s: %s", DiscoveryCacheDir, err)
+		return ""
+	}
+	sum := sha256.Sum256([]byte(serverURL))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// ReadDiscoveryCache returns the cached discovery document for the
+// server URL, or nil if there is none
+func ReadDiscoveryCache(serverURL string) *DiscoveryCacheEntry {
+	file := discoveryCacheFile(serverURL)
+	if len(file) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	var entry DiscoveryCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		log.Debugf("Cannot parse %s: %s", file, err)
+		return nil
+	}
+	if entry.Server != serverURL {
+		return nil
+	}
+	return &entry
+}
+
+func writeDiscoveryCache(entry DiscoveryCacheEntry) {
+	file := discoveryCacheFile(entry.Server)
+	if len(file) == 0 {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		log.Debugf("Cannot create %s: %s", filepath.Dir(file), err)
+		return
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		log.Debugf("Cannot write %s: %s", file, err)
+	}
+}
+
+// FlushDiscoveryCache removes the cached discovery document for the server URL
+func FlushDiscoveryCache(serverURL string) error {
+	file := discoveryCacheFile(serverURL)
+	if len(file) == 0 {
+		return nil
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cacheLifetime returns how long the response can be cached, at most ttl
+func cacheLifetime(header http.Header, now time.Time, ttl time.Duration) time.Duration {
+	if cc := header.Get("Cache-Control"); len(cc) > 0 {
+		for _, directive := range strings.Split(cc, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			switch {
+			case directive == "no-cache" || directive == "no-store":
+				return 0
+			case strings.HasPrefix(directive, "max-age="):
+				if n, err := strconv.Atoi(directive[len("max-age="):]); err == nil {
+					if d := time.Duration(n) * time.Second; d < ttl {
+						return d
+					}
+					return ttl
+				}
+			}
+		}
+	}
+	if exp := header.Get("Expires"); len(exp) > 0 {
+		if t, err := http.ParseTime(exp); err == nil {
+			if d := t.Sub(now); d < ttl {
+				if d < 0 {
+					return 0
+				}
+				return d
+			}
+		} else {
+			// Invalid Expires means already expired
+			return 0
+		}
+	}
+	return ttl
+}
+
+// fetchServerData retrieves the server metadata from the first
+// discovery URL that returns it, and returns it as a cache entry with
+// the given ttl
+func fetchServerData(serverURL string, ttl time.Duration) (ServerData, DiscoveryCacheEntry, error) {
+	var err error
+	for _, cfgURL := range discoveryURLs(serverURL) {
+		var d ServerData
+		var entry DiscoveryCacheEntry
+		d, entry, err = fetchDiscoveryDocument(cfgURL, ttl)
+		if err == nil {
+			entry.Server = serverURL
+			return d, entry, nil
+		}
+		log.Debugf("%s", err)
+	}
+	return ServerData{}, DiscoveryCacheEntry{}, err
+}
+
+// fetchDiscoveryDocument retrieves the server metadata from cfgURL
+func fetchDiscoveryDocument(cfgURL string, ttl time.Duration) (ServerData, DiscoveryCacheEntry, error) {
+	log.Debugf("Getting server info from %s", cfgURL)
+	resp, err := proto.HTTPGet(cfgURL)
+	if err != nil {
+		return ServerData{}, DiscoveryCacheEntry{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ServerData{}, DiscoveryCacheEntry{}, fmt.Errorf("Cannot get SSO server information from %s: %s", cfgURL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ServerData{}, DiscoveryCacheEntry{}, err
+	}
+	var d ServerData
+	if err := json.Unmarshal(data, &d); err != nil {
+		return ServerData{}, DiscoveryCacheEntry{}, fmt.Errorf("Cannot get SSO server information from %s: %s", cfgURL, err.Error())
+	}
+	now := time.Now()
+	return d, DiscoveryCacheEntry{URL: cfgURL,
+		Fetched:  now.Unix(),
+		Expires:  now.Add(cacheLifetime(resp.Header, now, ttl)).Unix(),
+		Document: data}, nil
+}
+
+// RefreshServerData retrieves the discovery document from the auth
+// server, and replaces the cached copy
+func RefreshServerData(serverURL string, ttl time.Duration) (ServerData, error) {
+	d, entry, err := fetchServerData(serverURL, ttl)
+	if err != nil {
+		return d, err
+	}
+	writeDiscoveryCache(entry)
+	return d, nil
+}
+
+// GetCachedServerData returns the server data from the discovery
+// cache if it is fresh. Otherwise, it is retrieved from the auth
+// server and cached. If the auth server cannot be reached, the stale
+// copy is used
+func GetCachedServerData(serverURL string, ttl time.Duration) (ServerData, error) {
+	cached := ReadDiscoveryCache(serverURL)
+	if cached != nil && cached.Fresh(time.Now(), ttl) {
+		var d ServerData
+		if err := json.Unmarshal(cached.Document, &d); err == nil {
+			log.Debugf("Using cached server info for %s", cached.URL)
+			return d, nil
+		}
+	}
+	d, err := RefreshServerData(serverURL, ttl)
+	if err != nil && cached != nil {
+		var stale ServerData
+		if json.Unmarshal(cached.Document, &stale) == nil {
+			log.Warnf("Cannot get server info, using cached copy from %s: %s", time.Unix(cached.Fetched, 0).Format(time.RFC3339), err)
+			return stale, nil
+		}
+	}
+	return d, err
+}
+
+// discoveryTTL returns the discovery cache ttl of the configuration
+func discoveryTTL(config Config) (time.Duration, error) {
+	if len(config.DiscoveryTTL) == 0 {
+		return DefaultDiscoveryTTL, nil
+	}
+	ttl, err := time.ParseDuration(config.DiscoveryTTL)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid discovery ttl %s: %s", config.DiscoveryTTL, err)
+	}
+	return ttl, nil
+}
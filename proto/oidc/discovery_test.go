@@ -0,0 +1,144 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Do not use the user discovery cache in tests
+	DiscoveryCacheDir = ""
+	os.Exit(m.Run())
+}
+
+func TestGetCachedServerData(t *testing.T) {
+	DiscoveryCacheDir = t.TempDir()
+	defer func() { DiscoveryCacheDir = "" }()
+
+	requests := 0
+	down := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if down {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		requests++
+		fmt.Fprintf(w, `{"token_endpoint":"http://token/%d"}`, requests)
+	}))
+	defer server.Close()
+
+	d, err := GetCachedServerData(server.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.TokenEndpoint != "http://token/1" {
+		t.Errorf("Wrong token endpoint: %s", d.TokenEndpoint)
+	}
+	d, _ = GetCachedServerData(server.URL, time.Hour)
+	if requests != 1 || d.TokenEndpoint != "http://token/1" {
+		t.Errorf("Cached document is not used: %d %s", requests, d.TokenEndpoint)
+	}
+
+	// Expired entry is retrieved again
+	d, _ = GetCachedServerData(server.URL, 0)
+	if requests != 2 || d.TokenEndpoint != "http://token/2" {
+		t.Errorf("Expired document is used: %d %s", requests, d.TokenEndpoint)
+	}
+
+	// Stale copy is used if the server is down
+	down = true
+	d, err = GetCachedServerData(server.URL, time.Hour)
+	if err != nil {
+		t.Errorf("Stale copy is not used: %s", err)
+	}
+	if d.TokenEndpoint != "http://token/2" {
+		t.Errorf("Wrong stale document: %s", d.TokenEndpoint)
+	}
+
+	if err := FlushDiscoveryCache(server.URL); err != nil {
+		t.Error(err)
+	}
+	if ReadDiscoveryCache(server.URL) != nil {
+		t.Errorf("Cache is not flushed")
+	}
+	if _, err := GetCachedServerData(server.URL, time.Hour); err == nil {
+		t.Errorf("Expecting error without a cached copy")
+	}
+}
+
+func TestCacheLifetime(t *testing.T) {
+	now := time.Now()
+	for _, x := range []struct {
+		header   http.Header
+		expected time.Duration
+	}{
+		{http.Header{}, time.Hour},
+		{http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute},
+		{http.Header{"Cache-Control": {"max-age=86400"}}, time.Hour},
+		{http.Header{"Cache-Control": {"no-cache"}}, 0},
+		{http.Header{"Expires": {now.Add(10 * time.Minute).UTC().Format(http.TimeFormat)}}, 10 * time.Minute},
+		{http.Header{"Expires": {"0"}}, 0},
+	} {
+		d := cacheLifetime(x.header, now, time.Hour)
+		if d < x.expected-time.Second || d > x.expected {
+			t.Errorf("Wrong lifetime for %v: %s", x.header, d)
+		}
+	}
+}
+
+func TestDiscoveryURLs(t *testing.T) {
+	urls := discoveryURLs("https://host/realms/r")
+	expected := []string{"https://host/realms/r/.well-known/openid-configuration",
+		"https://host/.well-known/oauth-authorization-server/realms/r",
+		"https://host/realms/r/.well-known/oauth-authorization-server"}
+	if len(urls) != len(expected) {
+		t.Fatalf("Wrong urls: %v", urls)
+	}
+	for i := range urls {
+		if urls[i] != expected[i] {
+			t.Errorf("Wrong url: %s, expected %s", urls[i], expected[i])
+		}
+	}
+	if urls := discoveryURLs("https://host"); len(urls) != 2 {
+		t.Errorf("Wrong urls: %v", urls)
+	}
+}
+
+func TestGetServerData_AuthorizationServerMetadata(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/oauth-authorization-server/tenant", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"issuer":"%s/tenant","token_endpoint":"%s/token","introspection_endpoint":"%s/introspect","revocation_endpoint":"%s/revoke"}`, server.URL, server.URL, server.URL, server.URL)
+	})
+
+	d, err := GetServerData(server.URL + "/tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.TokenEndpoint != server.URL+"/token" || d.IntrospectionEndpoint != server.URL+"/introspect" || d.RevocationEndpoint != server.URL+"/revoke" {
+		t.Errorf("Wrong server data: %+v", d)
+	}
+}
+
+func TestGetServerData_NoDiscovery(t *testing.T) {
+	config := Config{ServerProfile: ServerProfile{URL: "http://unreachable.invalid/base",
+		NoDiscovery:      true,
+		AuthAPI:          "/authorize",
+		TokenAPI:         "https://token.invalid/token",
+		IntrospectionAPI: "introspect"}}
+	d, err := getServerData(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.AuthorizationEndpoint != "http://unreachable.invalid/base/authorize" ||
+		d.TokenEndpoint != "https://token.invalid/token" ||
+		d.IntrospectionEndpoint != "http://unreachable.invalid/base/introspect" ||
+		len(d.RevocationEndpoint) != 0 {
+		t.Errorf("Wrong server data: %+v", d)
+	}
+}
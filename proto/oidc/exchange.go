@@ -0,0 +1,79 @@
+package oidc
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+
+	"github.com/bserdar/took/proto"
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// maxExchangeDepth limits the length of token exchange chains, so a
+// remote referring back to itself fails instead of looping forever
+const maxExchangeDepth = 8
+
+var exchangeDepth = 0
+
+// TokenExchangeConfig declares another remote as the source of the
+// subject token, and the parameters of the token exchange request
+type TokenExchangeConfig struct {
+	// Subject is the name of the remote configuration to get the subject token from
+	Subject string `yaml:"subject" mapstructure:"subject"`
+	// SubjectUser is the username for the subject remote. If empty,
+	// the username of the token request is used
+	SubjectUser string `yaml:"subjectuser,omitempty" mapstructure:"subjectuser,omitempty"`
+	// Audience is the logical name of the target service
+	Audience string `yaml:"audience,omitempty" mapstructure:"audience,omitempty"`
+	// Resource is the URI of the target service
+	Resource string `yaml:"resource,omitempty" mapstructure:"resource,omitempty"`
+	// Scopes are the scopes requested for the new token
+	Scopes []string `yaml:"scopes,omitempty" mapstructure:"scopes,omitempty"`
+	// RequestedTokenType is the type of the requested token. Defaults to access token
+	RequestedTokenType string `yaml:"requestedtokentype,omitempty" mapstructure:"requestedtokentype,omitempty"`
+}
+
+// ExchangeToken gets the subject token from the subject remote, and
+// exchanges it at the token endpoint for a new token
+func ExchangeToken(auth ClientAuth, x TokenExchangeConfig, userName, tokenURL string) (oauth2.Token, error) {
+	if exchangeDepth >= maxExchangeDepth {
+		return oauth2.Token{}, fmt.Errorf("Token exchange chain is too long at %s", x.Subject)
+	}
+	subjectUser := x.SubjectUser
+	if len(subjectUser) == 0 {
+		subjectUser = userName
+	}
+	log.Debugf("Getting subject token from %s for %s", x.Subject, subjectUser)
+	// The subject remote may use different TLS settings
+	insecure, certs, roots := proto.InsecureTLS, proto.ClientCertificates, proto.RootCAs
+	exchangeDepth++
+	subjectToken, err := proto.GetRemoteToken(x.Subject, proto.TokenRequest{Username: subjectUser})
+	exchangeDepth--
+	proto.InsecureTLS, proto.ClientCertificates, proto.RootCAs = insecure, certs, roots
+	if err != nil {
+		return oauth2.Token{}, fmt.Errorf("Cannot get subject token from %s: %s", x.Subject, err)
+	}
+
+	values := url.Values{}
+	values.Set("grant_type", tokenExchangeGrantType)
+	values.Set("subject_token", subjectToken)
+	values.Set("subject_token_type", accessTokenType)
+	Target{Resource: x.Resource, Audience: x.Audience}.setValues(values)
+	if len(x.Scopes) > 0 {
+		values.Set("scope", strings.Join(x.Scopes, " "))
+	}
+	requestedType := x.RequestedTokenType
+	if len(requestedType) == 0 {
+		requestedType = accessTokenType
+	}
+	values.Set("requested_token_type", requestedType)
+	log.Debugf("Token exchange %s", tokenURL)
+	return postTokenRequest(auth, tokenURL, values)
+}
@@ -0,0 +1,64 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bserdar/took/cfg"
+	"github.com/bserdar/took/proto"
+)
+
+func TestGetToken_Exchange(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"token_endpoint":"%s/token"}`, server.URL)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		switch req.Form.Get("grant_type") {
+		case "password":
+			if req.Form.Get("username") != "user" {
+				t.Errorf("Wrong user: %v", req.Form)
+			}
+			w.Write([]byte(`{"access_token":"subject","token_type":"bearer"}`))
+		case tokenExchangeGrantType:
+			if req.Form.Get("subject_token") != "subject" ||
+				req.Form.Get("subject_token_type") != accessTokenType ||
+				req.Form.Get("audience") != "backend" {
+				t.Errorf("Wrong exchange request: %v", req.Form)
+			}
+			w.Write([]byte(`{"access_token":"exchanged","token_type":"bearer","issued_token_type":"urn:ietf:params:oauth:token-type:access_token"}`))
+		default:
+			t.Errorf("Unexpected grant: %v", req.Form)
+		}
+	})
+
+	tr := true
+	cfg.UserCfg.Remotes = map[string]cfg.Remote{
+		"frontend": {Type: "oidc", Configuration: Config{ServerProfile: ServerProfile{URL: server.URL, PasswordGrant: &tr},
+			ClientID: "frontend"}}}
+	defer func() { cfg.UserCfg.Remotes = nil }()
+	cfg.AskPasswordWithPrompt = func(s string) string { return "pwd" }
+
+	p := Protocol{}
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL},
+		ClientID:      "backend",
+		ClientSecret:  "secret",
+		TokenExchange: &TokenExchangeConfig{Subject: "frontend", Audience: "backend"}}
+
+	ret, _, err := p.GetToken(proto.TokenRequest{Username: "user"})
+	if err != nil {
+		t.Errorf("Cannot get token: %v", err)
+	}
+	if ret != "exchanged" {
+		t.Errorf("Wrong token: %s", ret)
+	}
+	if cfg.UserCfg.Remotes["frontend"].Data == nil {
+		t.Errorf("Subject token is not stored")
+	}
+}
@@ -3,10 +3,11 @@ package oidc
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -26,8 +27,22 @@ type HTMLFormConfig struct {
 	// Which field in Fields is the username field
 	UsernameField string        `json:"usernameField,omitempty" yaml:"usernameField,omitempty"`
 	Fields        []FieldConfig `json:"fields,omitempty" yaml:"fields,omitempty"`
+	// ErrorSelector selects the element containing the error message
+	// of a failed login, like div.alert-error. Tag names, #id, .class,
+	// and [attr=value] selectors are supported
+	ErrorSelector string `json:"errorSelector,omitempty" yaml:"errorSelector,omitempty"`
+	// MaxAttempts is the number of times credentials are asked if
+	// login fails. Defaults to 3
+	MaxAttempts int `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty"`
+	// Auto detects the username and password fields of the login
+	// form. Fields are used in addition to the detected fields
+	Auto bool `json:"auto,omitempty" yaml:"auto,omitempty"`
 }
 
+// FormAuto is the form configuration, given as a string, that
+// detects the login form
+const FormAuto = "auto"
+
 // FieldConfig describes an HTML field in the HTML form
 type FieldConfig struct {
 	Input string `json:"input" yaml:"input"`
@@ -36,6 +51,11 @@ type FieldConfig struct {
 	Password bool   `json:"password" yaml:"password"`
 	// If non-empty, the default value
 	Value string `json:"value,omitempty" yaml:"value,omitempty"`
+	// Kind is empty for a plain field, or totp for a time-based
+	// one-time password
+	Kind string `json:"kind,omitempty" yaml:"kind,omitempty"`
+	// Seed is the base32 TOTP seed. If empty, the code is asked
+	Seed string `json:"seed,omitempty" yaml:"seed,omitempty"`
 }
 
 // ReadPage reads the contents of the page
@@ -58,143 +78,577 @@ func findAttr(attr string, n *html.Node) string {
 	return ""
 }
 
-func getFields(node *html.Node) url.Values {
-	ret := url.Values{}
-	if node.Type == html.ElementNode && node.DataAtom == atom.Input {
-		inputType := findAttr("type", node)
-		name := findAttr("name", node)
-		value := findAttr("value", node)
-		if inputType == "text" || inputType == "password" || inputType == "hidden" {
-			ret.Set(name, value)
+// hasAttr returns true if the node has the attribute, like disabled or checked
+func hasAttr(attr string, n *html.Node) bool {
+	for _, a := range n.Attr {
+		if strings.ToLower(a.Key) == attr {
+			return true
 		}
 	}
-	merge := func(m url.Values) {
-		for k, v := range m {
-			ret.Set(k, v[0])
+	return false
+}
+
+// nodeText returns the text content of the node
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(nodeText(c))
+	}
+	return b.String()
+}
+
+// optionValue returns the value of an option, which is the option
+// text if there is no value attribute
+func optionValue(n *html.Node) string {
+	for _, a := range n.Attr {
+		if strings.ToLower(a.Key) == "value" {
+			return a.Val
 		}
 	}
-	if node.FirstChild != nil {
-		merge(getFields(node.FirstChild))
+	return strings.Join(strings.Fields(nodeText(n)), " ")
+}
+
+// selectValues returns the selected options of a select, or the
+// first option if none is selected and the select is not multiple
+func selectValues(n *html.Node) []string {
+	var options []*html.Node
+	var itr func(*html.Node)
+	itr = func(node *html.Node) {
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && c.DataAtom == atom.Option {
+				options = append(options, c)
+			} else if c.Type == html.ElementNode && c.DataAtom == atom.Optgroup && !hasAttr("disabled", c) {
+				itr(c)
+			}
+		}
 	}
-	for trc := node.NextSibling; trc != nil; trc = trc.NextSibling {
-		merge(getFields(trc))
+	itr(n)
+	var ret []string
+	for _, o := range options {
+		if hasAttr("selected", o) && !hasAttr("disabled", o) {
+			ret = append(ret, optionValue(o))
+		}
+	}
+	if len(ret) == 0 && !hasAttr("multiple", n) {
+		for _, o := range options {
+			if !hasAttr("disabled", o) {
+				return []string{optionValue(o)}
+			}
+		}
 	}
 	return ret
 }
 
-func containsAll(fields url.Values, required []string) bool {
-	for _, x := range required {
-		if _, ok := fields[x]; !ok {
-			return false
+// formControls returns the values a browser submits for the form
+// without any user input, and the names of all the controls of the
+// form. Disabled controls, unchecked checkboxes and radio buttons,
+// and submit buttons other than the first one are not submitted
+func formControls(form *html.Node) (url.Values, map[string]bool) {
+	values := url.Values{}
+	names := map[string]bool{}
+	submitted := false
+	var itr func(*html.Node)
+	itr = func(node *html.Node) {
+		if node.Type != html.ElementNode {
+			return
+		}
+		name := findAttr("name", node)
+		disabled := hasAttr("disabled", node)
+		switch node.DataAtom {
+		case atom.Fieldset:
+			if disabled {
+				return
+			}
+		case atom.Input:
+			if len(name) == 0 || disabled {
+				return
+			}
+			inputType := strings.ToLower(findAttr("type", node))
+			value := findAttr("value", node)
+			switch inputType {
+			case "checkbox", "radio":
+				names[name] = true
+				if hasAttr("checked", node) {
+					if !hasAttr("value", node) {
+						value = "on"
+					}
+					values.Add(name, value)
+				}
+			case "submit", "image":
+				if !submitted {
+					submitted = true
+					if inputType == "image" {
+						values.Add(name+".x", "0")
+						values.Add(name+".y", "0")
+					} else {
+						values.Add(name, value)
+					}
+				}
+			case "button", "reset", "file":
+			default:
+				names[name] = true
+				values.Add(name, value)
+			}
+			return
+		case atom.Button:
+			buttonType := strings.ToLower(findAttr("type", node))
+			if len(name) > 0 && !disabled && !submitted && (buttonType == "" || buttonType == "submit") {
+				submitted = true
+				values.Add(name, findAttr("value", node))
+			}
+			return
+		case atom.Textarea:
+			if len(name) > 0 && !disabled {
+				names[name] = true
+				values.Add(name, nodeText(node))
+			}
+			return
+		case atom.Select:
+			if len(name) > 0 && !disabled {
+				names[name] = true
+				for _, v := range selectValues(node) {
+					values.Add(name, v)
+				}
+			}
+			return
+		}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			itr(c)
 		}
 	}
-	return true
+	for c := form.FirstChild; c != nil; c = c.NextSibling {
+		itr(c)
+	}
+	return values, names
 }
 
-func itrForms(formID string, requiredFields []string, node *html.Node) (string, url.Values) {
+// forms returns all forms under node
+func forms(node *html.Node) []*html.Node {
+	var ret []*html.Node
 	if node.Type == html.ElementNode && node.DataAtom == atom.Form {
-		if len(formID) == 0 || findAttr("id", node) == formID {
-			// Find the first form with these fields
-			action := findAttr("action", node)
-			fields := getFields(node.FirstChild)
-			if len(formID) > 0 || containsAll(fields, requiredFields) {
-				return action, fields
+		ret = append(ret, node)
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		ret = append(ret, forms(c)...)
+	}
+	return ret
+}
+
+// itrForms returns the form with formID and its fields. If formID
+// is empty, or if there is no such form, returns the first form
+// containing most of the fields, or nil if no form contains any
+func itrForms(formID string, fields []string, node *html.Node) (*html.Node, url.Values) {
+	var best *html.Node
+	var bestValues url.Values
+	bestCount := 0
+	for _, form := range forms(node) {
+		values, names := formControls(form)
+		if len(formID) > 0 && findAttr("id", form) == formID {
+			return form, values
+		}
+		count := 0
+		for _, f := range fields {
+			if names[f] {
+				count++
 			}
 		}
+		if count > bestCount {
+			best, bestValues, bestCount = form, values, count
+		}
 	}
-	if node.FirstChild != nil {
-		s, f := itrForms(formID, requiredFields, node.FirstChild)
-		if s != "" {
-			return s, f
+	return best, bestValues
+}
+
+// autoFields returns the names of the username and password inputs
+// of the first form with exactly one password input and a text or
+// email input before it. If there is no such form, returns the
+// password input of the first form with exactly one password input,
+// and empty username. Returns empty strings if there is no such form
+func autoFields(page *html.Node) (username, password string) {
+	found := false
+	for _, form := range forms(page) {
+		var user, pwd string
+		var inputs []*html.Node
+		var itr func(*html.Node)
+		itr = func(n *html.Node) {
+			if n.Type == html.ElementNode && n.DataAtom == atom.Input && len(findAttr("name", n)) > 0 && !hasAttr("disabled", n) {
+				inputs = append(inputs, n)
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				itr(c)
+			}
+		}
+		itr(form)
+		passwords := 0
+		for _, input := range inputs {
+			switch strings.ToLower(findAttr("type", input)) {
+			case "", "text", "email":
+				if passwords == 0 {
+					user = findAttr("name", input)
+				}
+			case "password":
+				passwords++
+				pwd = findAttr("name", input)
+			}
+		}
+		if passwords != 1 {
+			continue
+		}
+		if len(user) > 0 {
+			return user, pwd
 		}
+		if !found {
+			found = true
+			password = pwd
+		}
+	}
+	return "", password
+}
+
+// pageConfig returns the form configuration for the page. If the
+// configuration is automatic, the detected username and password
+// fields are added to the fields
+func pageConfig(config HTMLFormConfig, page *html.Node) HTMLFormConfig {
+	if !config.Auto {
+		return config
+	}
+	username, password := autoFields(page)
+	ret := config
+	ret.Auto = false
+	ret.UsernameField = username
+	ret.PasswordField = password
+	ret.Fields = nil
+	if len(username) > 0 {
+		ret.Fields = append(ret.Fields, FieldConfig{Input: username, Prompt: "Username"})
 	}
-	for trc := node.NextSibling; trc != nil; trc = trc.NextSibling {
-		s, f := itrForms(formID, requiredFields, trc)
-		if s != "" {
-			return s, f
+	if len(password) > 0 {
+		ret.Fields = append(ret.Fields, FieldConfig{Input: password, Prompt: "Password", Password: true})
+	}
+	ret.Fields = append(ret.Fields, config.Fields...)
+	return ret
+}
+
+// loginForm returns the login form of the page and its values, or nil
+func loginForm(config HTMLFormConfig, page *html.Node) (*html.Node, url.Values) {
+	config = pageConfig(config, page)
+	fields := make([]string, 0)
+	for _, f := range config.Fields {
+		fields = append(fields, f.Input)
+	}
+	return itrForms(config.ID, fields, page)
+}
+
+// loginFields returns the configured fields of the login form of the
+// page, or empty string if there is no login form
+func loginFields(config HTMLFormConfig, page *html.Node) string {
+	config = pageConfig(config, page)
+	form, _ := loginForm(config, page)
+	if form == nil {
+		return ""
+	}
+	_, names := formControls(form)
+	var ret []string
+	for _, f := range config.Fields {
+		if names[f.Input] {
+			ret = append(ret, f.Input)
 		}
 	}
-	return "", nil
+	return strings.Join(ret, ",")
 }
 
-// FillForm processes the form, prompts the user for field values, and returns the form to be submitted
+// loginFailed checks if the page returned after submitting login
+// forms shows a failed login. A failed login either shows the error
+// selected by the error selector of the configuration, or shows a
+// login form asking for the same fields as one of the submitted
+// forms. Returns the error message, if any
+func loginFailed(config HTMLFormConfig, page *html.Node, submitted []string) (bool, string) {
+	var msg string
+	if len(config.ErrorSelector) > 0 {
+		sel, err := ParseSelector(config.ErrorSelector)
+		if err != nil {
+			log.Warnf("%s", err)
+		} else {
+			msg = sel.Text(page)
+		}
+	}
+	if len(msg) > 0 {
+		return true, msg
+	}
+	fields := loginFields(config, page)
+	if len(fields) == 0 {
+		return false, ""
+	}
+	for _, x := range submitted {
+		if x == fields {
+			return true, ""
+		}
+	}
+	return false, ""
+}
+
+// errNoForm is returned if a page does not have a login form
+var errNoForm = errors.New("Cannot find login form")
+
+// FillForm processes the form, prompts the user for field values, and
+// returns the form to be submitted. The form containing most of the
+// configured fields is used, and only the fields in that form are
+// filled, so a login spanning multiple pages can be filled page by
+// page. If the configuration is automatic, the username and password
+// fields are detected
 func FillForm(config HTMLFormConfig, page *html.Node, userName, password string) (action string, values url.Values, err error) {
-	requiredFields := make([]string, 0)
-	for _, f := range config.Fields {
-		requiredFields = append(requiredFields, f.Input)
-	}
-	action, values = itrForms(config.ID, requiredFields, page)
-	if action != "" {
-		for _, field := range config.Fields {
-			if field.Input == config.UsernameField && len(userName) > 0 {
-				// This is the username
-				values.Set(field.Input, userName)
-			} else if field.Input == config.PasswordField && len(password) > 0 {
-				// This is the password
-				values.Set(field.Input, password)
-			} else {
-				ask := cfg.Ask
-				if field.Password {
-					ask = cfg.AskPasswordWithPrompt
+	return fillForm(config, page, userName, password, false)
+}
+
+// fillForm fills the form as FillForm. If retry is set, the password
+// is asked even if the password field has no prompt
+func fillForm(config HTMLFormConfig, page *html.Node, userName, password string, retry bool) (action string, values url.Values, err error) {
+	config = pageConfig(config, page)
+	form, values := loginForm(config, page)
+	if form == nil {
+		return "", nil, errNoForm
+	}
+	action = findAttr("action", form)
+	_, names := formControls(form)
+	if err := fillFields(config, names, values, userName, password, retry); err != nil {
+		return "", nil, err
+	}
+	return action, values, nil
+}
+
+// fillFields sets the values of the configured fields that are among
+// the names of the form controls, asking the user if necessary. If
+// retry is set, the password field is always asked
+func fillFields(config HTMLFormConfig, names map[string]bool, values url.Values, userName, password string, retry bool) error {
+	for _, field := range config.Fields {
+		if !names[field.Input] {
+			// Login pages may ask for some of the fields only
+			continue
+		}
+		if field.Kind == FieldKindTOTP {
+			code, err := totpValue(field)
+			if err != nil {
+				return err
+			}
+			values.Set(field.Input, code)
+		} else if field.Input == config.UsernameField && len(userName) > 0 {
+			// This is the username
+			values.Set(field.Input, userName)
+		} else if field.Input == config.PasswordField && len(password) > 0 {
+			// This is the password
+			values.Set(field.Input, password)
+		} else {
+			if retry && field.Input == config.PasswordField {
+				// The password is asked again after a failed login,
+				// even if the field has no prompt
+				field.Password = true
+				if field.Prompt == "" {
+					field.Prompt = "Password"
 				}
-				if field.Prompt != "" {
-					if field.Value == "" {
-						var v string
-						v = ask(fmt.Sprintf("%s:", field.Prompt))
-						values.Set(field.Input, v)
-					} else {
-						defaultValue := field.Value
-						if field.Password {
-							defaultValue = "***"
-						}
-						var val string
-						val = ask(fmt.Sprintf("%s (%s):", field.Prompt, defaultValue))
-						if len(val) == 0 {
-							val = field.Value
-						}
-						values.Set(field.Input, val)
-					}
+			}
+			ask := cfg.Ask
+			if field.Password {
+				ask = cfg.AskPasswordWithPrompt
+			}
+			if field.Prompt != "" {
+				if field.Value == "" {
+					var v string
+					v = ask(fmt.Sprintf("%s:", field.Prompt))
+					values.Set(field.Input, v)
 				} else {
-					values.Set(field.Input, field.Value)
+					defaultValue := field.Value
+					if field.Password {
+						defaultValue = "***"
+					}
+					var val string
+					val = ask(fmt.Sprintf("%s (%s):", field.Prompt, defaultValue))
+					if len(val) == 0 {
+						val = field.Value
+					}
+					values.Set(field.Input, val)
 				}
+			} else {
+				values.Set(field.Input, field.Value)
 			}
 		}
 	}
-	return action, values, nil
+	return nil
+}
+
+// totpValue returns the TOTP code for the field generated from its
+// seed, or asks for it if there is no seed
+func totpValue(field FieldConfig) (string, error) {
+	if len(field.Seed) > 0 {
+		return TOTP(field.Seed, time.Now())
+	}
+	prompt := field.Prompt
+	if len(prompt) == 0 {
+		prompt = "One-time code"
+	}
+	return cfg.Ask(fmt.Sprintf("%s:", prompt)), nil
+}
+
+// maxFormSteps is the maximum number of login pages submitted in one authentication attempt
+const maxFormSteps = 10
+
+// maxRedirects is the maximum number of redirects followed after
+// retrieving a login page
+const maxRedirects = 10
+
+// defaultFormAttempts is the default number of login attempts
+const defaultFormAttempts = 3
+
+// formSession is an HTTP session with the login pages of a server.
+// Cookies are kept between requests, and redirects are followed until
+// a redirect to the callback URL
+type formSession struct {
+	cli         *http.Client
+	callbackURL string
+	// redirectedURL is set when the server redirects to the callback URL
+	redirectedURL *url.URL
+	// posted is set after a form is submitted
+	posted bool
+}
+
+// newFormSession returns a new session using the cookie jar, or a
+// new cookie jar if jar is nil. If callbackURL is empty, the first
+// redirect after submitting a form is taken as the callback
+func newFormSession(callbackURL string, jar http.CookieJar) (*formSession, error) {
+	if jar == nil {
+		var err error
+		if jar, err = cookiejar.New(nil); err != nil {
+			return nil, err
+		}
+	}
+	s := &formSession{cli: proto.GetHTTPClient(), callbackURL: callbackURL}
+	s.cli.Jar = jar
+	s.cli.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if (len(callbackURL) > 0 && strings.HasPrefix(req.URL.String(), callbackURL)) ||
+			(len(callbackURL) == 0 && s.posted) {
+			s.redirectedURL = req.URL
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= maxRedirects {
+			return errors.New("Too many redirects")
+		}
+		log.Debugf("Following redirect to %s", req.URL)
+		return nil
+	}
+	return s, nil
+}
+
+// get retrieves the page at pageURL
+func (s *formSession) get(pageURL string) (*http.Response, error) {
+	log.Debugf("Reading login page at %s", pageURL)
+	return s.cli.Get(pageURL)
+}
+
+// post submits a form to the action, resolved relative to pageURL
+func (s *formSession) post(pageURL *url.URL, action string, values url.Values) (*http.Response, error) {
+	actionURL, err := pageURL.Parse(action)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("posting to %s", actionURL)
+	s.posted = true
+	return s.cli.PostForm(actionURL.String(), values)
+}
+
+// formPostResponse checks if the page is a form_post authorization
+// response, that is, a form submitting the response to the callback
+// URL. If so, the form values are set as the query of the redirected
+// URL, and returns true
+func (s *formSession) formPostResponse(page *html.Node, pageURL *url.URL) bool {
+	if len(s.callbackURL) == 0 {
+		return false
+	}
+	for _, form := range forms(page) {
+		action, err := pageURL.Parse(findAttr("action", form))
+		if err != nil || !strings.HasPrefix(action.String(), s.callbackURL) {
+			continue
+		}
+		values, _ := formControls(form)
+		action.RawQuery = values.Encode()
+		s.redirectedURL = action
+		return true
+	}
+	return false
 }
 
 // FormAuth retrieves a login form from the authURL, parses it, asks
-// credentials, submits the form, and if everything goes fine, returns
-// the redirect URL
-func FormAuth(cfg HTMLFormConfig, authURL string, userName, password string) *url.URL {
-	var redirectedURL *url.URL
-	log.Debugf("Reading login page at %s", authURL)
-	node, cookies, err := ReadPage(authURL)
-	if err == nil && node != nil {
-		action, values, err := FillForm(cfg, node, userName, password)
-		log.Debugf("action=%s err=%s", action, err)
-		if err == nil && action != "" && values != nil {
-			formData := values.Encode()
-			request, _ := http.NewRequest(http.MethodPost, action, ioutil.NopCloser(strings.NewReader(formData)))
-			for _, c := range cookies {
-				request.AddCookie(c)
-			}
-			log.Debugf("posting...")
-			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			request.ContentLength = int64(len(formData))
-			cli := proto.GetHTTPClient()
-			cli.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-				redirectedURL = req.URL
-				return errors.New("Redirect")
-			}
-			response, err := cli.Do(request)
-			log.Debugf("Response: %+v %v", response, err)
-			if err == nil {
-				defer response.Body.Close()
+// credentials, and submits the form. If the response is another
+// login page, that form is filled and submitted as well. Cookies are
+// kept between pages, and redirects are followed until a redirect to
+// the callbackURL. If everything goes fine, returns the redirect
+// URL. If callbackURL is empty, the first redirect after submitting a
+// form is returned. If the server shows the login form again, the
+// login failed, and the credentials are asked again up to
+// config.MaxAttempts times. If jar is nonnil, it keeps the cookies
+// of the login session. If it contains the cookies of a live login
+// session, the server may redirect to the callbackURL without asking
+// credentials
+func FormAuth(config HTMLFormConfig, authURL, callbackURL string, userName, password string, jar http.CookieJar) *url.URL {
+	maxAttempts := config.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultFormAttempts
+	}
+	// submitted keeps the fields of the forms submitted in this attempt
+	var submitted []string
+	session, err := newFormSession(callbackURL, jar)
+	if err != nil {
+		log.Debugf("err:%s", err)
+		return nil
+	}
+	response, err := session.get(authURL)
+	attempt := 1
+	for err == nil && session.redirectedURL == nil {
+		if len(submitted) >= maxFormSteps {
+			err = errors.New("Too many login pages")
+			response.Body.Close()
+			break
+		}
+		var page *html.Node
+		page, err = html.Parse(response.Body)
+		response.Body.Close()
+		if err != nil {
+			break
+		}
+		if session.formPostResponse(page, response.Request.URL) {
+			break
+		}
+		if len(submitted) > 0 {
+			if failed, msg := loginFailed(config, page, submitted); failed {
+				if len(msg) > 0 {
+					fmt.Printf("Login failed: %s\n", msg)
+				} else {
+					fmt.Printf("Login failed\n")
+				}
+				if attempt >= maxAttempts {
+					err = errors.New("Too many failed login attempts")
+					break
+				}
+				attempt++
+				// Ask the password again
+				password = ""
+				submitted = nil
 			}
 		}
-	} else {
+		fields := loginFields(config, page)
+		var action string
+		var values url.Values
+		action, values, err = fillForm(config, page, userName, password, attempt > 1)
+		if err != nil {
+			break
+		}
+		submitted = append(submitted, fields)
+		response, err = session.post(response.Request.URL, action, values)
+	}
+	if err != nil {
 		log.Debugf("err:%s", err)
+	} else {
+		response.Body.Close()
 	}
-	return redirectedURL
+	return session.redirectedURL
 }
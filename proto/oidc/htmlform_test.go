@@ -1,15 +1,16 @@
 package oidc
 
 import (
+	"fmt"
 	"golang.org/x/net/html"
-	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/bserdar/took/cfg"
-	"github.com/bserdar/took/proto"
 )
 
 var multipleForms = `<html>
@@ -100,22 +101,301 @@ func TestFormAuth(t *testing.T) {
 		Fields: []FieldConfig{{Input: "field1", Password: true},
 			{Input: "field2"}}}
 	handler := testFormAuthHandler{headers: make(map[string]string)}
-	server := httptest.NewServer(&handler)
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
 	defer server.Close()
-
-	proto.HTTPGet = func(url string) (*http.Response, error) {
-		return &http.Response{Status: "200 OK",
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(strings.Replace(emptyForm, "http://action", server.URL, -1)))}, nil
-	}
+	mux.HandleFunc("/login", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(strings.Replace(emptyForm, "http://action", server.URL+"/post", -1)))
+	})
+	mux.Handle("/post", &handler)
 	cfg.AskPasswordWithPrompt = func(prompt string) string { return "pass" }
 
 	handler.returnCode = http.StatusMovedPermanently
 	handler.headers["Location"] = "http://redirect"
 
-	u := FormAuth(config, server.URL, "", "")
-	proto.HTTPGet = proto.DefaultHTTPGet
+	u := FormAuth(config, server.URL+"/login", "", "", "", nil)
 	if u.String() != "http://redirect" {
 		t.Errorf("Wrong redirect: %v", u)
 	}
 }
+
+var usernamePage = `<html><body>
+<form action="next" method="post">
+<input type="hidden" name="step" value="1"/>
+<input type="text" name="username"/>
+</form>
+</body></html>`
+
+var passwordPage = `<html><body>
+<form action="/idp/password" method="post">
+<input type="hidden" name="step" value="2"/>
+<input type="password" name="password"/>
+</form>
+</body></html>`
+
+func TestFormAuth_MultiStep(t *testing.T) {
+	config := HTMLFormConfig{PasswordField: "password", UsernameField: "username",
+		Fields: []FieldConfig{{Input: "username", Prompt: "User"},
+			{Input: "password", Prompt: "Password", Password: true}}}
+	asked := 0
+	cfg.Ask = func(prompt string) string {
+		asked++
+		return "user"
+	}
+	cfg.AskPasswordWithPrompt = func(prompt string) string {
+		asked++
+		return "pass"
+	}
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/idp/login", http.StatusFound)
+	})
+	mux.HandleFunc("/idp/login", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(usernamePage))
+	})
+	mux.HandleFunc("/idp/next", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.FormValue("step") != "1" || req.FormValue("username") != "user" {
+			t.Errorf("Wrong first page submission: %s %v", req.Method, req.Form)
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/"})
+		w.Write([]byte(passwordPage))
+	})
+	mux.HandleFunc("/idp/password", func(w http.ResponseWriter, req *http.Request) {
+		if c, err := req.Cookie("session"); err != nil || c.Value != "s1" {
+			t.Errorf("No session cookie")
+		}
+		if req.FormValue("step") != "2" || req.FormValue("password") != "pass" || len(req.Form["username"]) > 0 {
+			t.Errorf("Wrong second page submission: %v", req.Form)
+		}
+		http.Redirect(w, req, "/idp/consent", http.StatusFound)
+	})
+	mux.HandleFunc("/idp/consent", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "http://callback/cb?code=abc", http.StatusFound)
+	})
+
+	u := FormAuth(config, server.URL+"/auth", "http://callback/cb", "", "", nil)
+	if u == nil || u.Query().Get("code") != "abc" {
+		t.Errorf("Wrong redirect: %v", u)
+	}
+	if asked != 2 {
+		t.Errorf("Expected 2 prompts, got %d", asked)
+	}
+}
+
+var controlsForm = `<html><body>
+<form id="consent" action="consent">
+<input type="email" name="email" value="u@example.com"/>
+<input name="notype" value="nt"/>
+<input type="checkbox" name="scope" value="openid" checked/>
+<input type="checkbox" name="scope" value="profile" checked/>
+<input type="checkbox" name="scope" value="email"/>
+<input type="checkbox" name="remember" checked/>
+<input type="radio" name="choice" value="a"/>
+<input type="radio" name="choice" value="b" checked/>
+<input type="text" name="disabled" value="x" disabled/>
+<fieldset disabled><input type="text" name="infieldset" value="y"/></fieldset>
+<textarea name="comment">Some text</textarea>
+<select name="lang">
+<option value="en">English</option>
+<option selected>  Deutsch </option>
+</select>
+<select name="first"><option value="1">One</option><option value="2">Two</option></select>
+<select name="multi" multiple><option value="1" selected>One</option><option value="2" selected>Two</option><option value="3">Three</option></select>
+<input type="file" name="file"/>
+<input type="reset" name="reset" value="Reset"/>
+<button type="button" name="cancel" value="cancel">Cancel</button>
+<button name="accept" value="yes">Accept</button>
+<input type="submit" name="deny" value="no"/>
+</form>
+</body></html>`
+
+func TestFormControls(t *testing.T) {
+	node, err := html.Parse(strings.NewReader(controlsForm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	form, values := itrForms("consent", nil, node)
+	if form == nil {
+		t.Fatal("Form not found")
+	}
+	expected := url.Values{"email": {"u@example.com"},
+		"notype":   {"nt"},
+		"scope":    {"openid", "profile"},
+		"remember": {"on"},
+		"choice":   {"b"},
+		"comment":  {"Some text"},
+		"lang":     {"Deutsch"},
+		"first":    {"1"},
+		"multi":    {"1", "2"},
+		"accept":   {"yes"}}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Wrong values: %v", values)
+	}
+	_, names := formControls(form)
+	for _, n := range []string{"email", "scope", "choice", "comment", "lang", "multi"} {
+		if !names[n] {
+			t.Errorf("Missing control %s", n)
+		}
+	}
+	if names["disabled"] || names["infieldset"] || names["accept"] {
+		t.Errorf("Wrong controls: %v", names)
+	}
+
+	// Configured fields fill unchecked checkboxes
+	config := HTMLFormConfig{ID: "consent", Fields: []FieldConfig{{Input: "scope", Value: "email"}}}
+	_, values, err = FillForm(config, node, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Get("scope") != "email" || values.Get("accept") != "yes" {
+		t.Errorf("Wrong values: %v", values)
+	}
+}
+
+func TestFormAuth_Retry(t *testing.T) {
+	config := HTMLFormConfig{PasswordField: "password", UsernameField: "username",
+		ErrorSelector: "div.alert-error",
+		Fields: []FieldConfig{{Input: "username", Prompt: "User"},
+			{Input: "password", Prompt: "Password", Password: true}}}
+	passwords := []string{"wrong", "pass"}
+	asked := 0
+	cfg.AskPasswordWithPrompt = func(prompt string) string {
+		p := passwords[asked%len(passwords)]
+		asked++
+		return p
+	}
+	loginPage := `<html><body>%s<form action="/login">
+<input type="text" name="username"/>
+<input type="password" name="password"/>
+</form></body></html>`
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			fmt.Fprintf(w, loginPage, "")
+			return
+		}
+		if req.FormValue("username") != "user" || req.FormValue("password") != "pass" {
+			fmt.Fprintf(w, loginPage, `<div class="alert-error">Invalid password</div>`)
+			return
+		}
+		http.Redirect(w, req, "http://callback/?code=abc", http.StatusFound)
+	})
+
+	u := FormAuth(config, server.URL+"/login", "http://callback/", "user", "", nil)
+	if u == nil || u.Query().Get("code") != "abc" {
+		t.Errorf("Wrong redirect: %v", u)
+	}
+	if asked != 2 {
+		t.Errorf("Expected 2 password prompts, got %d", asked)
+	}
+
+	// Always fails, no error message
+	asked = 0
+	passwords = []string{"wrong"}
+	config.ErrorSelector = ""
+	config.MaxAttempts = 2
+	if u := FormAuth(config, server.URL+"/login", "http://callback/", "user", "", nil); u != nil {
+		t.Errorf("Expected failure, got %v", u)
+	}
+	if asked != 2 {
+		t.Errorf("Expected 2 password prompts, got %d", asked)
+	}
+
+	// Password field without a prompt is still asked again
+	asked = 0
+	passwords = []string{"pass"}
+	config.ErrorSelector = "div.alert-error"
+	config.MaxAttempts = 0
+	config.Fields[1] = FieldConfig{Input: "password"}
+	cfg.AskPasswordWithPrompt = func(prompt string) string {
+		if prompt != "Password:" {
+			t.Errorf("Wrong prompt: %s", prompt)
+		}
+		p := passwords[asked%len(passwords)]
+		asked++
+		return p
+	}
+	if u := FormAuth(config, server.URL+"/login", "http://callback/", "user", "wrong", nil); u == nil || u.Query().Get("code") != "abc" {
+		t.Errorf("Wrong redirect: %v", u)
+	}
+	if asked != 1 {
+		t.Errorf("Expected 1 password prompt, got %d", asked)
+	}
+
+	// Configured password is used without asking on the first attempt
+	asked = 0
+	config.Fields[1] = FieldConfig{Input: "password", Value: "pass"}
+	if u := FormAuth(config, server.URL+"/login", "http://callback/", "user", "", nil); u == nil || u.Query().Get("code") != "abc" {
+		t.Errorf("Wrong redirect: %v", u)
+	}
+	if asked != 0 {
+		t.Errorf("Expected no password prompts, got %d", asked)
+	}
+}
+
+var autoPage = `<html><body>
+<form action="/search"><input type="text" name="q"/></form>
+<form action="/signup"><input type="email" name="email"/><input type="password" name="p1"/><input type="password" name="p2"/></form>
+<form action="/login">
+<input type="hidden" name="csrf" value="token"/>
+<input type="email" name="login"/>
+<input type="password" name="secret"/>
+<input type="text" name="after"/>
+</form>
+</body></html>`
+
+func TestFillForm_Auto(t *testing.T) {
+	node, err := html.Parse(strings.NewReader(autoPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, p := autoFields(node); u != "login" || p != "secret" {
+		t.Errorf("Wrong fields: %s %s", u, p)
+	}
+	cfg.AskPasswordWithPrompt = func(prompt string) string { return "pass" }
+	action, values, err := FillForm(HTMLFormConfig{Auto: true}, node, "user", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action != "/login" || values.Get("login") != "user" || values.Get("secret") != "pass" ||
+		values.Get("csrf") != "token" {
+		t.Errorf("Wrong form: %s %v", action, values)
+	}
+
+	// Second page of an identifier-first login
+	node, err = html.Parse(strings.NewReader(passwordPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, p := autoFields(node); u != "" || p != "password" {
+		t.Errorf("Wrong fields: %s %s", u, p)
+	}
+}
+
+func TestFormAuth_FormPost(t *testing.T) {
+	config := HTMLFormConfig{Auto: true}
+	cfg.AskPasswordWithPrompt = func(prompt string) string { return "pass" }
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`<html><body><form action="/login" method="post">
+<input type="text" name="user"/><input type="password" name="pwd"/>
+</form></body></html>`))
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, req *http.Request) {
+		// form_post response mode
+		w.Write([]byte(`<html><body onload="document.forms[0].submit()">
+<form method="post" action="http://callback/cb">
+<input type="hidden" name="code" value="abc"/><input type="hidden" name="state" value="s"/>
+</form></body></html>`))
+	})
+	u := FormAuth(config, server.URL+"/auth", "http://callback/cb", "user", "", nil)
+	if u == nil || u.Query().Get("code") != "abc" || u.Query().Get("state") != "s" {
+		t.Errorf("Wrong response: %v", u)
+	}
+}
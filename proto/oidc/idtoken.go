@@ -0,0 +1,122 @@
+package oidc
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+
+	// Hash implementations for at_hash
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// nonceRandomLength is the number of random bytes of the nonce sent in authorization requests
+const nonceRandomLength = 16
+
+// idTokenClaims are the ID token claims checked by took
+type idTokenClaims struct {
+	jwt.Claims
+	Nonce           string `json:"nonce,omitempty"`
+	AccessTokenHash string `json:"at_hash,omitempty"`
+	AuthorizedParty string `json:"azp,omitempty"`
+}
+
+// VerifyIDToken verifies the signature and the claims of the ID
+// token. The token must be issued by the server to the client. If
+// nonce is nonempty, the token must contain the same nonce. If the
+// token contains at_hash, it must match the access token
+func VerifyIDToken(raw string, serverData ServerData, auth ClientAuth, nonce, accessToken string, now time.Time) error {
+	var claims idTokenClaims
+	var tok *jwt.JSONWebToken
+	var err error
+	if alg := jwtAlgorithm(raw); strings.HasPrefix(alg, "HS") {
+		// Symmetric signatures use the client secret as the key,
+		// so they can only be trusted by confidential clients
+		if !auth.hasSharedSecret() {
+			return fmt.Errorf("ID token is signed with %s, but the client has no secret", alg)
+		}
+		if tok, err = jwt.ParseSigned(raw); err == nil {
+			err = tok.Claims([]byte(auth.ClientSecret), &claims)
+		}
+	} else if len(serverData.JWKSUri) == 0 {
+		return fmt.Errorf("Server does not publish its keys, use --jwks-api to verify ID tokens")
+	} else {
+		tok, err = VerifyJWT(raw, serverData, &claims)
+	}
+	if err != nil {
+		return err
+	}
+	if err := claims.Validate(jwt.Expected{Issuer: serverData.Issuer, Audience: jwt.Audience{auth.ClientID}, Time: now}); err != nil {
+		return err
+	}
+	if len(claims.AuthorizedParty) > 0 && claims.AuthorizedParty != auth.ClientID {
+		return fmt.Errorf("ID token authorized party is %s", claims.AuthorizedParty)
+	}
+	if len(nonce) > 0 && claims.Nonce != nonce {
+		return fmt.Errorf("Invalid nonce")
+	}
+	if len(claims.AccessTokenHash) > 0 && len(accessToken) > 0 {
+		h, err := accessTokenHash(accessToken, tok.Headers[0].Algorithm)
+		if err != nil {
+			return err
+		}
+		if h != claims.AccessTokenHash {
+			return fmt.Errorf("Access token does not match at_hash")
+		}
+	}
+	return nil
+}
+
+// jwtAlgorithm returns the alg header of a signed JWT, or empty string
+func jwtAlgorithm(raw string) string {
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil || len(tok.Headers) == 0 {
+		return ""
+	}
+	return tok.Headers[0].Algorithm
+}
+
+// accessTokenHash computes at_hash: the left half of the hash of the
+// access token, using the hash function of the signature algorithm
+func accessTokenHash(accessToken, alg string) (string, error) {
+	var h crypto.Hash
+	switch jose.SignatureAlgorithm(alg) {
+	case jose.RS256, jose.ES256, jose.PS256, jose.HS256:
+		h = crypto.SHA256
+	case jose.RS384, jose.ES384, jose.PS384, jose.HS384:
+		h = crypto.SHA384
+	case jose.RS512, jose.ES512, jose.PS512, jose.HS512, jose.EdDSA:
+		h = crypto.SHA512
+	default:
+		return "", fmt.Errorf("Unsupported ID token algorithm: %s", alg)
+	}
+	hash := h.New()
+	hash.Write([]byte(accessToken))
+	sum := hash.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
+
+// idTokenUsable returns true if there is an ID token that does not
+// expire within window
+func (t TokenData) idTokenUsable(window time.Duration, now time.Time) bool {
+	if len(t.IDToken) == 0 {
+		return false
+	}
+	tok, err := jwt.ParseSigned(t.IDToken)
+	if err != nil {
+		return false
+	}
+	var c jwt.Claims
+	if tok.UnsafeClaimsWithoutVerification(&c) != nil {
+		return false
+	}
+	if c.Expiry == nil {
+		return true
+	}
+	return !tooClose(c.Expiry.Time(), now, window)
+}
@@ -0,0 +1,111 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/bserdar/took/cfg"
+	"github.com/bserdar/took/proto"
+)
+
+func TestVerifyIDToken(t *testing.T) {
+	ks := newTestKeyServer(t)
+	defer ks.server.Close()
+	now := time.Now()
+	auth := ClientAuth{ClientID: "id", ClientSecret: "a-client-secret-that-is-long-enough"}
+	atHash, _ := accessTokenHash("access", "RS256")
+	claims := func(aud, nonce, atHash string) idTokenClaims {
+		return idTokenClaims{Claims: jwt.Claims{Issuer: ks.server.URL,
+			Audience: jwt.Audience{aud},
+			Expiry:   jwt.NewNumericDate(now.Add(time.Hour))},
+			Nonce:           nonce,
+			AccessTokenHash: atHash}
+	}
+
+	if err := VerifyIDToken(ks.sign(t, claims("id", "n", atHash)), ks.serverData(), auth, "n", "access", now); err != nil {
+		t.Errorf("ID token should be valid: %s", err)
+	}
+	if VerifyIDToken(ks.sign(t, claims("id", "other", atHash)), ks.serverData(), auth, "n", "access", now) == nil {
+		t.Errorf("Wrong nonce")
+	}
+	if VerifyIDToken(ks.sign(t, claims("other", "n", atHash)), ks.serverData(), auth, "n", "access", now) == nil {
+		t.Errorf("Wrong audience")
+	}
+	if VerifyIDToken(ks.sign(t, claims("id", "n", atHash)), ks.serverData(), auth, "n", "other", now) == nil {
+		t.Errorf("Wrong at_hash")
+	}
+	if VerifyIDToken(ks.sign(t, claims("id", "n", atHash)), ks.serverData(), auth, "n", "access", now.Add(2*time.Hour)) == nil {
+		t.Errorf("Expired")
+	}
+
+	// Signed with the client secret
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte(auth.ClientSecret)}, nil)
+	hs, _ := jwt.Signed(signer).Claims(claims("id", "", "")).CompactSerialize()
+	if err := VerifyIDToken(hs, ks.serverData(), auth, "", "access", now); err != nil {
+		t.Errorf("HS256 ID token should be valid: %s", err)
+	}
+	auth.ClientSecret = "another-client-secret-that-is-long"
+	if VerifyIDToken(hs, ks.serverData(), auth, "", "access", now) == nil {
+		t.Errorf("Wrong client secret")
+	}
+
+	// Public clients cannot verify symmetric signatures
+	signer, _ = jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("")}, nil)
+	forged, _ := jwt.Signed(signer).Claims(claims("id", "", "")).CompactSerialize()
+	if VerifyIDToken(forged, ks.serverData(), ClientAuth{ClientID: "id"}, "", "access", now) == nil {
+		t.Errorf("HS256 ID token of a public client should be rejected")
+	}
+	auth = ClientAuth{ClientID: "id", ClientSecret: "a-client-secret-that-is-long-enough", Method: PrivateKeyJWT}
+	if VerifyIDToken(hs, ks.serverData(), auth, "", "access", now) == nil {
+		t.Errorf("HS256 ID token should be rejected without client secret authentication")
+	}
+}
+
+func TestGetToken_IDToken(t *testing.T) {
+	ks := newTestKeyServer(t)
+	defer ks.server.Close()
+	mux := ks.server.Config.Handler.(*http.ServeMux)
+	idToken := ks.sign(t, idTokenClaims{Claims: jwt.Claims{Issuer: ks.server.URL,
+		Audience: jwt.Audience{"id"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour))}})
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"issuer":"%s","token_endpoint":"%s/token","jwks_uri":"%s/keys"}`, ks.server.URL, ks.server.URL, ks.server.URL)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"a","token_type":"bearer","id_token":"%s"}`, idToken)
+	})
+
+	p := Protocol{}
+	tr := true
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: ks.server.URL, PasswordGrant: &tr},
+		ClientID: "id"}
+	cfg.AskPasswordWithPrompt = func(s string) string { return "pwd" }
+
+	ret, _, err := p.GetToken(proto.TokenRequest{Username: "user", IDToken: true})
+	if err != nil {
+		t.Fatalf("Cannot get token: %v", err)
+	}
+	if ret != idToken {
+		t.Errorf("Wrong ID token: %s", ret)
+	}
+	if p.Tokens.Tokens[0].IDToken != idToken {
+		t.Errorf("ID token is not stored")
+	}
+
+	// ID token signed with an unknown key is rejected
+	ks.kid = "other"
+	p.Tokens = Data{}
+	idToken = ks.sign(t, idTokenClaims{Claims: jwt.Claims{Issuer: ks.server.URL,
+		Audience: jwt.Audience{"id"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour))}})
+	ks.kid = "k1"
+	if _, _, err := p.GetToken(proto.TokenRequest{Username: "user", IDToken: true}); err == nil {
+		t.Errorf("Expected error")
+	}
+}
@@ -0,0 +1,117 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Response types of the authorization request
+const (
+	responseTypeCode    = "code"
+	responseTypeToken   = "token"
+	responseTypeIDToken = "id_token"
+)
+
+// responseTypes returns the response types of the configured
+// response type, like "code id_token". The default is code
+func responseTypes(responseType string) (map[string]bool, error) {
+	ret := map[string]bool{}
+	for _, t := range strings.Fields(responseType) {
+		switch t {
+		case responseTypeCode, responseTypeToken, responseTypeIDToken:
+			ret[t] = true
+		default:
+			return nil, fmt.Errorf("Invalid response type: %s Use a combination of '%s', '%s', and '%s'", responseType, responseTypeCode, responseTypeToken, responseTypeIDToken)
+		}
+	}
+	if len(ret) == 0 {
+		ret[responseTypeCode] = true
+	}
+	return ret, nil
+}
+
+// isIDTokenOnly returns true if the response type returns only an ID
+// token, and no access token
+func isIDTokenOnly(responseType string) bool {
+	types, err := responseTypes(responseType)
+	return err == nil && len(types) == 1 && types[responseTypeIDToken]
+}
+
+// authResponseValues returns the authorization response parameters in
+// the query and the fragment of the redirected URL
+func authResponseValues(u *url.URL) url.Values {
+	ret := u.Query()
+	if fragment, err := url.ParseQuery(u.EscapedFragment()); err == nil {
+		for k, v := range fragment {
+			for _, x := range v {
+				ret.Add(k, x)
+			}
+		}
+	}
+	return ret
+}
+
+// parseAuthResponse parses the authorization response pasted by the
+// user. The input can be the redirected URL, with the response in the
+// query or the fragment, the form_post body, or the authorization
+// code. Returns true if the input is only the code
+func parseAuthResponse(in string) (url.Values, bool, error) {
+	in = strings.TrimSpace(in)
+	if strings.Contains(in, "://") {
+		u, err := url.Parse(in)
+		if err != nil {
+			return nil, false, err
+		}
+		return authResponseValues(u), false, nil
+	}
+	if strings.Contains(in, "=") {
+		values, err := url.ParseQuery(strings.TrimLeft(in, "?#"))
+		return values, false, err
+	}
+	if len(in) == 0 {
+		return nil, false, fmt.Errorf("No authorization response")
+	}
+	return url.Values{"code": {in}}, true, nil
+}
+
+// implicitToken returns the token in the authorization response of
+// the implicit or hybrid flow received at time now
+func implicitToken(values url.Values, now time.Time) oauth2.Token {
+	return tokenResponse{AccessToken: values.Get("access_token"),
+		TokenType: values.Get("token_type"),
+		ExpiresIn: json.Number(values.Get("expires_in")),
+		Scope:     values.Get("scope"),
+		IDToken:   values.Get("id_token")}.Token(now)
+}
+
+// verifyCodeHash checks the c_hash claim of a verified ID token
+// against the authorization code returned with it
+func verifyCodeHash(idToken, code string) error {
+	tok, err := jwt.ParseSigned(idToken)
+	if err != nil {
+		return err
+	}
+	var claims struct {
+		CodeHash string `json:"c_hash"`
+	}
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return err
+	}
+	if len(claims.CodeHash) == 0 {
+		return fmt.Errorf("ID token does not have c_hash")
+	}
+	h, err := accessTokenHash(code, tok.Headers[0].Algorithm)
+	if err != nil {
+		return err
+	}
+	if h != claims.CodeHash {
+		return fmt.Errorf("Authorization code does not match c_hash")
+	}
+	return nil
+}
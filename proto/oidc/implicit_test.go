@@ -0,0 +1,191 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/bserdar/took/cfg"
+	"github.com/bserdar/took/proto"
+)
+
+func TestParseAuthResponse(t *testing.T) {
+	tests := []struct {
+		in    string
+		code  string
+		token string
+		state string
+		bare  bool
+	}{{"http://callback?code=c&state=s", "c", "", "s", false},
+		{"http://callback#access_token=a%2Fb&state=s", "", "a/b", "s", false},
+		{"http://callback?state=s#code=c&id_token=x", "c", "", "s", false},
+		{"code=c&state=s", "c", "", "s", false},
+		{"#access_token=a&state=s", "", "a", "s", false},
+		{"  c123 \n", "c123", "", "", true}}
+	for _, x := range tests {
+		values, bare, err := parseAuthResponse(x.in)
+		if err != nil {
+			t.Errorf("%s: %s", x.in, err)
+			continue
+		}
+		if values.Get("code") != x.code || values.Get("access_token") != x.token || values.Get("state") != x.state || bare != x.bare {
+			t.Errorf("%s: wrong response %v %v", x.in, values, bare)
+		}
+	}
+	if _, _, err := parseAuthResponse(""); err == nil {
+		t.Errorf("Empty response accepted")
+	}
+}
+
+func TestResponseTypes(t *testing.T) {
+	if types, err := responseTypes(""); err != nil || !types["code"] || len(types) != 1 {
+		t.Errorf("Wrong default: %v %v", types, err)
+	}
+	if types, err := responseTypes("code id_token"); err != nil || !types["code"] || !types["id_token"] || types["token"] {
+		t.Errorf("Wrong types: %v %v", types, err)
+	}
+	if _, err := responseTypes("code other"); err == nil {
+		t.Errorf("Invalid response type accepted")
+	}
+}
+
+// authURLParams returns the query of the authorization URL in the prompt
+func authURLParams(t *testing.T, prompt string) url.Values {
+	u, err := url.Parse(regexp.MustCompile(`http://\S+`).FindString(prompt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query()
+}
+
+func TestGetToken_Implicit(t *testing.T) {
+	ks := newTestKeyServer(t)
+	defer ks.server.Close()
+	mux := ks.server.Config.Handler.(*http.ServeMux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"issuer":"%s","authorization_endpoint":"%s/auth","token_endpoint":"%s/token","jwks_uri":"%s/keys"}`, ks.server.URL, ks.server.URL, ks.server.URL, ks.server.URL)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("code") != "thecode" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"coded","token_type":"bearer","expires_in":300}`)
+	})
+	idToken := func(nonce string, extra map[string]interface{}) string {
+		atHash, _ := accessTokenHash("a", "RS256")
+		claims := map[string]interface{}{"iss": ks.server.URL,
+			"aud":     "id",
+			"exp":     time.Now().Add(time.Hour).Unix(),
+			"nonce":   nonce,
+			"at_hash": atHash}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return ks.sign(t, claims)
+	}
+
+	p := Protocol{}
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: ks.server.URL, ResponseType: "id_token token"},
+		ClientID:    "id",
+		CallbackURL: "http://callback"}
+	var id string
+	cfg.Ask = func(prompt string) string {
+		q := authURLParams(t, prompt)
+		if q.Get("response_type") != "id_token token" {
+			t.Errorf("Wrong response type: %s", q.Get("response_type"))
+		}
+		id = idToken(q.Get("nonce"), nil)
+		return fmt.Sprintf("http://callback#access_token=a&token_type=bearer&expires_in=300&id_token=%s&state=%s", id, q.Get("state"))
+	}
+	ret, _, err := p.GetToken(proto.TokenRequest{Username: "user"})
+	if err != nil {
+		t.Fatalf("Cannot get token: %s", err)
+	}
+	if ret != "a" || p.Tokens.Tokens[0].IDToken != id || p.Tokens.Tokens[0].Expiry == 0 {
+		t.Errorf("Wrong token: %s %+v", ret, p.Tokens.Tokens[0])
+	}
+
+	// Wrong state
+	p.Tokens = Data{}
+	cfg.Ask = func(prompt string) string {
+		q := authURLParams(t, prompt)
+		return fmt.Sprintf("http://callback#access_token=a&id_token=%s&state=x", idToken(q.Get("nonce"), nil))
+	}
+	if _, _, err := p.GetToken(proto.TokenRequest{Username: "user"}); err == nil {
+		t.Errorf("Expected state error")
+	}
+
+	// Hybrid flow, the ID token must match the code
+	p.Tokens = Data{}
+	p.Cfg.ResponseType = "code id_token"
+	cHash, _ := accessTokenHash("thecode", "RS256")
+	cfg.Ask = func(prompt string) string {
+		q := authURLParams(t, prompt)
+		return fmt.Sprintf("http://callback#code=thecode&id_token=%s&state=%s", idToken(q.Get("nonce"), map[string]interface{}{"c_hash": cHash}), q.Get("state"))
+	}
+	if ret, _, err := p.GetToken(proto.TokenRequest{Username: "user"}); err != nil || ret != "coded" {
+		t.Errorf("Wrong hybrid token: %s %v", ret, err)
+	}
+	p.Tokens = Data{}
+	cfg.Ask = func(prompt string) string {
+		q := authURLParams(t, prompt)
+		return fmt.Sprintf("http://callback#code=thecode&id_token=%s&state=%s", idToken(q.Get("nonce"), map[string]interface{}{"c_hash": "x"}), q.Get("state"))
+	}
+	if _, _, err := p.GetToken(proto.TokenRequest{Username: "user"}); err == nil {
+		t.Errorf("Expected c_hash error")
+	}
+
+	// Authorization code pasted at the prompt
+	p.Tokens = Data{}
+	p.Cfg.ResponseType = ""
+	cfg.Ask = func(prompt string) string { return "thecode" }
+	if ret, _, err := p.GetToken(proto.TokenRequest{Username: "user"}); err != nil || ret != "coded" {
+		t.Errorf("Wrong token for pasted code: %s %v", ret, err)
+	}
+}
+
+func TestGetToken_IDTokenOnly(t *testing.T) {
+	ks := newTestKeyServer(t)
+	defer ks.server.Close()
+	mux := ks.server.Config.Handler.(*http.ServeMux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"issuer":"%s","authorization_endpoint":"%s/auth","token_endpoint":"%s/token","jwks_uri":"%s/keys"}`, ks.server.URL, ks.server.URL, ks.server.URL, ks.server.URL)
+	})
+
+	p := Protocol{}
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: ks.server.URL, ResponseType: "id_token"},
+		ClientID:    "id",
+		CallbackURL: "http://callback"}
+	var id string
+	asked := 0
+	cfg.Ask = func(prompt string) string {
+		asked++
+		q := authURLParams(t, prompt)
+		id = ks.sign(t, map[string]interface{}{"iss": ks.server.URL,
+			"aud":   "id",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": q.Get("nonce")})
+		return fmt.Sprintf("http://callback#id_token=%s&state=%s", id, q.Get("state"))
+	}
+
+	// There is no access token to return
+	if _, _, err := p.GetToken(proto.TokenRequest{Username: "user"}); err == nil || asked != 0 {
+		t.Errorf("Expected error for access token request: %v", err)
+	}
+
+	ret, _, err := p.GetToken(proto.TokenRequest{Username: "user", IDToken: true})
+	if err != nil || len(id) == 0 || ret != id {
+		t.Errorf("Wrong ID token: %s %v", ret, err)
+	}
+	// Cached ID token is used
+	ret, _, err = p.GetToken(proto.TokenRequest{Username: "user", IDToken: true})
+	if err != nil || ret != id || asked != 1 {
+		t.Errorf("Cached ID token is not used: %s %v %d", ret, err, asked)
+	}
+}
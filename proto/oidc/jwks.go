@@ -0,0 +1,131 @@
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	jose "gopkg.in/square/go-jose.v2"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/bserdar/took/proto"
+)
+
+// errNotJWT is returned when a token is not a signed JWT, so it cannot be validated locally
+var errNotJWT = errors.New("Token is not a JWT")
+
+// jwksCache keeps the key sets used during this run, by jwks uri
+var jwksCache = map[string]*jose.JSONWebKeySet{}
+
+// jwksCacheKey is the discovery cache key of the key set at uri
+func jwksCacheKey(uri string) string {
+	return "jwks " + uri
+}
+
+// GetJWKS retrieves the key set from the jwks uri. Key sets are
+// cached in the discovery cache for DefaultDiscoveryTTL, or less if
+// the server response says so. If refresh is false and there is a
+// cached copy, it is returned. If the key set cannot be retrieved,
+// the expired cached copy is used
+func GetJWKS(uri string, refresh bool) (*jose.JSONWebKeySet, error) {
+	if len(uri) == 0 {
+		return nil, fmt.Errorf("Server does not publish jwks_uri")
+	}
+	if keys, ok := jwksCache[uri]; ok && !refresh {
+		return keys, nil
+	}
+	cached := ReadDiscoveryCache(jwksCacheKey(uri))
+	if cached != nil && !refresh && cached.Fresh(time.Now(), DefaultDiscoveryTTL) {
+		var keys jose.JSONWebKeySet
+		if err := json.Unmarshal(cached.Document, &keys); err == nil {
+			log.Debugf("Using cached keys for %s", uri)
+			jwksCache[uri] = &keys
+			return &keys, nil
+		}
+	}
+	keys, err := fetchJWKS(uri)
+	if err != nil && cached != nil {
+		var stale jose.JSONWebKeySet
+		if json.Unmarshal(cached.Document, &stale) == nil {
+			log.Warnf("Cannot get keys, using cached copy from %s: %s", time.Unix(cached.Fetched, 0).Format(time.RFC3339), err)
+			jwksCache[uri] = &stale
+			return &stale, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	jwksCache[uri] = keys
+	return keys, nil
+}
+
+// fetchJWKS retrieves the key set from uri, and caches it
+func fetchJWKS(uri string) (*jose.JSONWebKeySet, error) {
+	log.Debugf("Getting keys from %s", uri)
+	resp, err := proto.HTTPGet(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Cannot get keys from %s: %s", uri, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("Cannot parse keys from %s: %s", uri, err)
+	}
+	now := time.Now()
+	writeDiscoveryCache(DiscoveryCacheEntry{Server: jwksCacheKey(uri),
+		URL:      uri,
+		Fetched:  now.Unix(),
+		Expires:  now.Add(cacheLifetime(resp.Header, now, DefaultDiscoveryTTL)).Unix(),
+		Document: data})
+	return &keys, nil
+}
+
+// VerifyJWT parses the signed JWT, verifies its signature using the
+// server keys, and decodes its claims into out. If the signing key is
+// not in the cached key set, the key set is retrieved again, because
+// the server may have rotated its keys. Returns errNotJWT if raw is
+// not a JWT
+func VerifyJWT(raw string, serverData ServerData, out ...interface{}) (*jwt.JSONWebToken, error) {
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, errNotJWT
+	}
+	if len(tok.Headers) == 0 {
+		return nil, errNotJWT
+	}
+	kid := tok.Headers[0].KeyID
+	for _, refresh := range []bool{false, true} {
+		keys, err := GetJWKS(serverData.JWKSUri, refresh)
+		if err != nil {
+			return nil, err
+		}
+		var candidates []jose.JSONWebKey
+		if len(kid) > 0 {
+			candidates = keys.Key(kid)
+		} else {
+			candidates = keys.Keys
+		}
+		for _, key := range candidates {
+			if key.Use == "enc" {
+				continue
+			}
+			if err := tok.Claims(key.Key, out...); err == nil {
+				return tok, nil
+			}
+		}
+		if len(candidates) > 0 {
+			break
+		}
+	}
+	return nil, fmt.Errorf("Cannot verify token signature")
+}
@@ -0,0 +1,265 @@
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Login script steps
+const (
+	// StepFetch retrieves a page. If URL is empty, retrieves the
+	// authorization URL
+	StepFetch = "fetch"
+	// StepForm selects a form of the current page by ID, or by
+	// the fields it must contain
+	StepForm = "form"
+	// StepFill sets the fields of the selected form
+	StepFill = "fill"
+	// StepSubmit submits the selected form
+	StepSubmit = "submit"
+	// StepExpectRedirect checks that the server redirected to the
+	// callback URL, or the current page is under URL
+	StepExpectRedirect = "expectRedirect"
+	// StepExpectText checks that the current page contains Text
+	StepExpectText = "expectText"
+	// StepAutoSubmit submits the forms of the pages without changes
+	// until the callback URL, a page without a form, or a page asking
+	// for a password is reached. If Text is nonempty, only the pages
+	// containing Text are submitted
+	StepAutoSubmit = "autoSubmit"
+)
+
+// LoginStep is a step of a login script
+type LoginStep struct {
+	// Step is one of fetch, form, fill, submit, expectRedirect, expectText, or autoSubmit
+	Step string `json:"step" yaml:"step" mapstructure:"step"`
+	// URL to fetch, relative to the current page, or the URL prefix to expect
+	URL string `json:"url,omitempty" yaml:"url,omitempty" mapstructure:"url,omitempty"`
+	// ID of the form to select
+	ID string `json:"id,omitempty" yaml:"id,omitempty" mapstructure:"id,omitempty"`
+	// Require is the list of fields the form to select must contain
+	Require []string `json:"require,omitempty" yaml:"require,omitempty" mapstructure:"require,omitempty"`
+	// UsernameField and PasswordField are the fields to fill with
+	// the username and password
+	UsernameField string `json:"usernameField,omitempty" yaml:"usernameField,omitempty" mapstructure:"usernameField,omitempty"`
+	PasswordField string `json:"passwordField,omitempty" yaml:"passwordField,omitempty" mapstructure:"passwordField,omitempty"`
+	// Fields to fill
+	Fields []FieldConfig `json:"fields,omitempty" yaml:"fields,omitempty" mapstructure:"fields,omitempty"`
+	// Text expected in the page
+	Text string `json:"text,omitempty" yaml:"text,omitempty" mapstructure:"text,omitempty"`
+}
+
+// loginScript is the state of a running login script
+type loginScript struct {
+	session  *formSession
+	authURL  string
+	userName string
+	password string
+
+	// The current page, its URL, and the selected form
+	page    *html.Node
+	pageURL *url.URL
+	form    *html.Node
+	values  url.Values
+	names   map[string]bool
+}
+
+// RunLoginScript runs the login steps starting with authURL, and
+// returns the URL the server redirected to, under callbackURL. If
+// the first step is not fetch, the authorization URL is fetched
+// first. If jar is nonnil, it keeps the cookies of the login
+// session. Once the server redirects to the callback URL, the
+// remaining steps are skipped
+func RunLoginScript(steps []LoginStep, authURL, callbackURL, userName, password string, jar http.CookieJar) (*url.URL, error) {
+	session, err := newFormSession(callbackURL, jar)
+	if err != nil {
+		return nil, err
+	}
+	script := &loginScript{session: session, authURL: authURL, userName: userName, password: password}
+	if len(steps) == 0 || steps[0].Step != StepFetch {
+		if err := script.fetch(""); err != nil {
+			return nil, err
+		}
+	}
+	for i, step := range steps {
+		if session.redirectedURL != nil {
+			break
+		}
+		log.Debugf("Login step %d: %s", i+1, step.Step)
+		if err := script.run(step); err != nil {
+			return nil, fmt.Errorf("Login step %d (%s): %s", i+1, step.Step, err)
+		}
+	}
+	if session.redirectedURL == nil {
+		return nil, errors.New("Login script did not reach the callback URL")
+	}
+	return session.redirectedURL, nil
+}
+
+// errLoginDone is returned by steps that need a page after the
+// callback URL is reached
+var errLoginDone = errors.New("Already redirected to the callback URL")
+
+func (s *loginScript) run(step LoginStep) error {
+	switch step.Step {
+	case StepFetch:
+		return s.fetch(step.URL)
+	case StepForm:
+		return s.selectForm(step.ID, step.Require)
+	case StepFill:
+		if s.form == nil {
+			return errNoForm
+		}
+		return fillFields(HTMLFormConfig{UsernameField: step.UsernameField,
+			PasswordField: step.PasswordField,
+			Fields:        step.Fields}, s.names, s.values, s.userName, s.password, false)
+	case StepSubmit:
+		if s.form == nil {
+			return errNoForm
+		}
+		return s.submit()
+	case StepExpectRedirect:
+		if len(step.URL) == 0 {
+			if s.session.redirectedURL == nil {
+				return errors.New("No redirect to the callback URL")
+			}
+			return nil
+		}
+		if s.session.redirectedURL != nil && strings.HasPrefix(s.session.redirectedURL.String(), step.URL) {
+			return nil
+		}
+		if s.pageURL == nil || !strings.HasPrefix(s.pageURL.String(), step.URL) {
+			return fmt.Errorf("Not redirected to %s", step.URL)
+		}
+		return nil
+	case StepExpectText:
+		if s.page == nil {
+			return errLoginDone
+		}
+		if !strings.Contains(nodeText(s.page), step.Text) {
+			return fmt.Errorf("Page does not contain %s", step.Text)
+		}
+		return nil
+	case StepAutoSubmit:
+		return s.autoSubmit(step.Text)
+	}
+	return fmt.Errorf("Unknown login step: %s", step.Step)
+}
+
+// setPage reads the response as the current page
+func (s *loginScript) setPage(response *http.Response) error {
+	defer response.Body.Close()
+	s.page, s.pageURL, s.form = nil, nil, nil
+	if s.session.redirectedURL != nil {
+		return nil
+	}
+	page, err := html.Parse(response.Body)
+	if err != nil {
+		return err
+	}
+	if s.session.formPostResponse(page, response.Request.URL) {
+		return nil
+	}
+	s.page, s.pageURL = page, response.Request.URL
+	return nil
+}
+
+func (s *loginScript) fetch(pageURL string) error {
+	if len(pageURL) == 0 {
+		pageURL = s.authURL
+	} else if s.pageURL != nil {
+		u, err := s.pageURL.Parse(pageURL)
+		if err != nil {
+			return err
+		}
+		pageURL = u.String()
+	}
+	response, err := s.session.get(pageURL)
+	if err != nil {
+		return err
+	}
+	return s.setPage(response)
+}
+
+// selectForm selects the form with the id, or the first form
+// containing all the required fields
+func (s *loginScript) selectForm(id string, require []string) error {
+	if s.page == nil {
+		return errLoginDone
+	}
+	for _, form := range forms(s.page) {
+		if len(id) > 0 && findAttr("id", form) != id {
+			continue
+		}
+		values, names := formControls(form)
+		found := true
+		for _, f := range require {
+			if !names[f] {
+				found = false
+				break
+			}
+		}
+		if found {
+			s.form, s.values, s.names = form, values, names
+			return nil
+		}
+	}
+	return errNoForm
+}
+
+func (s *loginScript) submit() error {
+	response, err := s.session.post(s.pageURL, findAttr("action", s.form), s.values)
+	if err != nil {
+		return err
+	}
+	return s.setPage(response)
+}
+
+// autoSubmit submits the first form of the pages, without changing
+// the fields, until a page without a form, a page with a password
+// field, or a page not containing text
+func (s *loginScript) autoSubmit(text string) error {
+	for i := 0; s.page != nil; i++ {
+		if i >= maxFormSteps {
+			return errors.New("Too many login pages")
+		}
+		if len(text) > 0 && !strings.Contains(nodeText(s.page), text) {
+			return nil
+		}
+		f := forms(s.page)
+		if len(f) == 0 {
+			return nil
+		}
+		s.form = f[0]
+		if hasPasswordInput(s.form) {
+			// Do not submit empty passwords
+			return nil
+		}
+		s.values, s.names = formControls(s.form)
+		if err := s.submit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasPasswordInput returns true if the form has a password input
+func hasPasswordInput(form *html.Node) bool {
+	if form.Type == html.ElementNode && form.DataAtom == atom.Input && strings.EqualFold(findAttr("type", form), "password") {
+		return true
+	}
+	for c := form.FirstChild; c != nil; c = c.NextSibling {
+		if hasPasswordInput(c) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package oidc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	yml "gopkg.in/yaml.v2"
+
+	"github.com/bserdar/took/cfg"
+)
+
+var testLoginScript = `
+url: http://server
+login:
+  - step: form
+    id: login-form
+  - step: fill
+    usernameField: username
+    fields:
+      - input: username
+  - step: submit
+  - step: expectText
+    text: Enter your password
+  - step: form
+    require: [password]
+  - step: fill
+    fields:
+      - input: password
+        prompt: Password
+        password: true
+  - step: submit
+  - step: autoSubmit
+    text: allow
+  - step: expectRedirect
+`
+
+func TestLoginScript(t *testing.T) {
+	var in interface{}
+	if err := yml.Unmarshal([]byte(testLoginScript), &in); err != nil {
+		t.Fatal(err)
+	}
+	var profile ServerProfile
+	cfg.Decode(in, &profile)
+	if len(profile.Login) != 9 || profile.Login[1].UsernameField != "username" ||
+		profile.Login[4].Require[0] != "password" || !profile.Login[5].Fields[0].Password {
+		t.Fatalf("Wrong script: %+v", profile.Login)
+	}
+
+	cfg.AskPasswordWithPrompt = func(prompt string) string { return "pass" }
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/login", http.StatusFound)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`<html><body>
+<form id="search" action="/search"><input type="text" name="q"/></form>
+<form id="login-form" action="/identify"><input type="text" name="username"/></form>
+</body></html>`))
+	})
+	mux.HandleFunc("/identify", func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("username") != "user" {
+			t.Errorf("Wrong username: %v", req.Form)
+		}
+		http.SetCookie(w, &http.Cookie{Name: "login", Value: "1", Path: "/"})
+		w.Write([]byte(`<html><body><p>Enter your password</p>
+<form action="/password"><input type="password" name="password"/></form>
+</body></html>`))
+	})
+	mux.HandleFunc("/password", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := req.Cookie("login"); err != nil || req.FormValue("password") != "pass" {
+			t.Errorf("Wrong password submission: %v", req.Form)
+		}
+		w.Write([]byte(`<html><body><p>Do you allow access?</p>
+<form action="/consent"><input type="hidden" name="c" value="1"/><button name="allow" value="yes">Yes</button></form>
+</body></html>`))
+	})
+	mux.HandleFunc("/consent", func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("c") != "1" || req.FormValue("allow") != "yes" {
+			t.Errorf("Wrong consent submission: %v", req.Form)
+		}
+		http.Redirect(w, req, "http://callback/?code=abc", http.StatusFound)
+	})
+
+	u, err := RunLoginScript(profile.Login, server.URL+"/auth", "http://callback/", "user", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("code") != "abc" {
+		t.Errorf("Wrong redirect: %v", u)
+	}
+
+	// Unexpected page
+	steps := []LoginStep{{Step: StepExpectText, Text: "Welcome"}}
+	if _, err := RunLoginScript(steps, server.URL+"/auth", "http://callback/", "user", "", nil); err == nil ||
+		!strings.Contains(err.Error(), "Welcome") {
+		t.Errorf("Expected error, got %v", err)
+	}
+	// Does not reach the callback. The password page is not auto-submitted
+	steps = []LoginStep{{Step: StepForm, ID: "login-form"},
+		{Step: StepFill, UsernameField: "username", Fields: []FieldConfig{{Input: "username"}}},
+		{Step: StepSubmit}, {Step: StepAutoSubmit}}
+	if _, err := RunLoginScript(steps, server.URL+"/auth", "http://callback/", "user", "", nil); err == nil {
+		t.Errorf("Expected error")
+	}
+}
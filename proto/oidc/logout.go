@@ -0,0 +1,170 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bserdar/took/proto"
+)
+
+// RevokeToken revokes the token using the revocation endpoint (RFC
+// 7009). The hint is refresh_token or access_token
+func RevokeToken(auth ClientAuth, token, hint, revocationURL string) error {
+	values := url.Values{}
+	values.Set("token", token)
+	if len(hint) > 0 {
+		values.Set("token_type_hint", hint)
+	}
+	log.Debugf("Revoking %s at %s", hint, revocationURL)
+	resp, err := auth.PostForm(revocationURL, values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		tokenErr := TokenError{}
+		json.NewDecoder(resp.Body).Decode(&tokenErr)
+		tokenErr.Status = resp.Status
+		return fmt.Errorf("Cannot revoke %s: %s", hint, tokenErr.Error())
+	}
+	return nil
+}
+
+// EndSession calls the end session endpoint to end the user session
+// at the server. The ID token is sent as a hint if there is one
+func EndSession(clientID, idToken, endSessionURL string) error {
+	u, err := url.Parse(endSessionURL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("client_id", clientID)
+	if len(idToken) > 0 {
+		q.Set("id_token_hint", idToken)
+	}
+	u.RawQuery = q.Encode()
+	log.Debugf("Ending session at %s", endSessionURL)
+	resp, err := proto.HTTPGet(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("Cannot end session: %s", resp.Status)
+	}
+	return nil
+}
+
+// Logout revokes the refresh and access tokens of the user, or all
+// users, optionally ends the session of each user once, and removes
+// the tokens and the stored login session cookies
+func (p *Protocol) Logout(request proto.LogoutRequest) (interface{}, error) {
+	config := p.GetConfig()
+	if config.Insecure {
+		proto.InsecureTLS = true
+	}
+	if err := setupTLS(config); err != nil {
+		return nil, err
+	}
+	userName := request.Username
+	if userName == "" {
+		userName = p.Tokens.Last
+	}
+	var logout []TokenData
+	var keep []TokenData
+	for _, tok := range p.Tokens.Tokens {
+		if request.All || tok.Username == userName {
+			logout = append(logout, tok)
+		} else {
+			keep = append(keep, tok)
+		}
+	}
+	if len(logout) == 0 {
+		if request.All && len(p.Tokens.Sessions) > 0 {
+			p.Tokens.Sessions = nil
+			return p.Tokens, nil
+		}
+		if !request.All && p.Tokens.sessionCookies(userName) != nil {
+			p.Tokens.removeSession(userName)
+			return p.Tokens, nil
+		}
+		return nil, fmt.Errorf("No tokens for %s", userName)
+	}
+
+	serverData, err := getServerData(config)
+	if err != nil {
+		return nil, err
+	}
+	auth := p.clientAuth(serverData)
+	if len(serverData.RevocationEndpoint) == 0 {
+		fmt.Printf("Server does not support token revocation, tokens are only removed locally\n")
+	}
+	if request.EndSession && len(serverData.EndSessionEndpoint) == 0 {
+		return nil, fmt.Errorf("Server does not have an end session endpoint")
+	}
+	if len(serverData.RevocationEndpoint) > 0 {
+		for _, tok := range logout {
+			if len(tok.RefreshToken) > 0 {
+				if err := RevokeToken(auth, tok.RefreshToken, "refresh_token", serverData.RevocationEndpoint); err != nil {
+					return nil, err
+				}
+			}
+			if len(tok.AccessToken) > 0 {
+				if err := RevokeToken(auth, tok.AccessToken, "access_token", serverData.RevocationEndpoint); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if request.EndSession {
+		// The tokens are revoked, so a failure to end a session
+		// does not keep them
+		for _, tok := range sessionTokens(logout) {
+			if err := EndSession(config.ClientID, tok.IDToken, serverData.EndSessionEndpoint); err != nil {
+				fmt.Printf("Cannot end session of %s: %s\n", tok.Username, err)
+			}
+		}
+	}
+	for _, tok := range logout {
+		log.Debugf("Logged out %s", tok.Username)
+	}
+	p.Tokens.Tokens = keep
+	// Forget the login sessions with the server
+	if request.All {
+		p.Tokens.Sessions = nil
+	} else {
+		p.Tokens.removeSession(userName)
+	}
+	if p.Tokens.findUser(p.Tokens.Last) == nil {
+		p.Tokens.Last = ""
+	}
+	return p.Tokens, nil
+}
+
+// sessionTokens returns one token for each user, the newest token
+// with an ID token if there is one, to be used as the end session hint
+func sessionTokens(tokens []TokenData) []TokenData {
+	var ret []TokenData
+	index := map[string]int{}
+	for _, tok := range tokens {
+		i, ok := index[tok.Username]
+		if !ok {
+			index[tok.Username] = len(ret)
+			ret = append(ret, tok)
+			continue
+		}
+		hasID, curHasID := len(tok.IDToken) > 0, len(ret[i].IDToken) > 0
+		if hasID != curHasID {
+			if hasID {
+				ret[i] = tok
+			}
+		} else if tok.IssuedAt > ret[i].IssuedAt {
+			ret[i] = tok
+		}
+	}
+	return ret
+}
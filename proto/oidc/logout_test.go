@@ -0,0 +1,89 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bserdar/took/proto"
+)
+
+func TestLogout(t *testing.T) {
+	revoked := map[string]string{}
+	var endSession []string
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"token_endpoint":"%s/token","revocation_endpoint":"%s/revoke","end_session_endpoint":"%s/logout"}`, server.URL, server.URL, server.URL)
+	})
+	mux.HandleFunc("/revoke", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if u, _, _ := req.BasicAuth(); u != "id" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		revoked[req.Form.Get("token")] = req.Form.Get("token_type_hint")
+	})
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, req *http.Request) {
+		if len(revoked) != 4 {
+			t.Errorf("Session ended before revoking tokens: %v", revoked)
+		}
+		endSession = append(endSession, req.URL.Query().Get("id_token_hint"))
+	})
+
+	p := Protocol{}
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL},
+		ClientID:     "id",
+		ClientSecret: "secret"}
+	p.Tokens = Data{Last: "u1",
+		Tokens: []TokenData{{Username: "u1", AccessToken: "a1", RefreshToken: "r1", IDToken: "i1", IssuedAt: 2},
+			{Username: "u1", AccessToken: "a0", IDToken: "i0", IssuedAt: 1},
+			{Username: "u1", AccessToken: "a4", IssuedAt: 3},
+			{Username: "u2", AccessToken: "a2", RefreshToken: "r2"},
+			{Username: "u3", AccessToken: "a3"}},
+		Sessions: []LoginSession{{Username: "u1", Cookies: []SessionCookie{{Name: "c1"}}},
+			{Username: "u2", Cookies: []SessionCookie{{Name: "c2"}}}}}
+
+	data, err := p.Logout(proto.LogoutRequest{EndSession: true})
+	if err != nil {
+		t.Fatalf("Cannot logout: %s", err)
+	}
+	if revoked["r1"] != "refresh_token" || revoked["a1"] != "access_token" || len(revoked) != 4 {
+		t.Errorf("Wrong revoked tokens: %v", revoked)
+	}
+	// Session is ended once, with the newest ID token
+	if len(endSession) != 1 || endSession[0] != "i1" {
+		t.Errorf("Session not ended: %v", endSession)
+	}
+	d := data.(Data)
+	if len(d.Tokens) != 2 || d.Last != "" {
+		t.Errorf("Tokens not removed: %+v", d)
+	}
+	if len(d.Sessions) != 1 || d.Sessions[0].Username != "u2" {
+		t.Errorf("Session not removed: %+v", d.Sessions)
+	}
+
+	if _, err := p.Logout(proto.LogoutRequest{Username: "u1"}); err == nil {
+		t.Errorf("Expected error for unknown user")
+	}
+
+	data, err = p.Logout(proto.LogoutRequest{All: true})
+	if err != nil {
+		t.Fatalf("Cannot logout: %s", err)
+	}
+	if len(revoked) != 7 || len(data.(Data).Tokens) != 0 {
+		t.Errorf("Not all tokens revoked: %v", revoked)
+	}
+
+	// Tokens are kept if revocation fails
+	p.Cfg.ClientID = "other"
+	p.Tokens = Data{Last: "u1", Tokens: []TokenData{{Username: "u1", AccessToken: "a1"}}}
+	if _, err := p.Logout(proto.LogoutRequest{}); err == nil {
+		t.Errorf("Expected error")
+	}
+	if len(p.Tokens.Tokens) != 1 {
+		t.Errorf("Tokens should not be removed")
+	}
+}
@@ -0,0 +1,171 @@
+package oidc
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LoopbackTimeout is how long took waits for the browser to redirect
+// to the local callback listener
+var LoopbackTimeout = 5 * time.Minute
+
+// OpenBrowser is initialized to DefaultOpenBrowser
+var OpenBrowser = DefaultOpenBrowser
+
+// DefaultOpenBrowser opens the URL using the platform browser launcher
+func DefaultOpenBrowser(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	return cmd.Start()
+}
+
+const loopbackResponsePage = `<html><body>Authentication complete. You can close this window.</body></html>`
+
+// loopbackRelayPage is returned if the authorization response is in
+// the URL fragment, which the browser does not send. The page sends
+// the fragment to the listener as the query
+const loopbackRelayPage = `<html><body>
+<script>
+if (window.location.hash.length > 1) {
+  window.location.replace(window.location.pathname + "?" + window.location.hash.substring(1));
+} else {
+  document.write("No authorization response.");
+}
+</script>
+</body></html>`
+
+// isAuthResponse returns true if the values contain an authorization response
+func isAuthResponse(values url.Values) bool {
+	for _, k := range []string{"code", "error", "access_token", "id_token"} {
+		if len(values.Get(k)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopbackURL returns true if the callback URL is an http:// URL
+// pointing to the local machine, so took can listen for the redirect
+func isLoopbackURL(callbackURL string) bool {
+	u, err := url.Parse(callbackURL)
+	if err != nil || strings.ToLower(u.Scheme) != "http" {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// loopbackListener is a short-lived HTTP server listening on the
+// callback URL for the authorization response
+type loopbackListener struct {
+	server *http.Server
+	result chan url.Values
+}
+
+// newLoopbackListener starts listening on the address of the callback URL
+func newLoopbackListener(callbackURL string) (*loopbackListener, error) {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if len(port) == 0 {
+		port = "80"
+	}
+	path := u.Path
+	if len(path) == 0 {
+		path = "/"
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot listen on %s: %s", callbackURL, err)
+	}
+	ret := &loopbackListener{result: make(chan url.Values, 1)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		// ParseForm collects both the query parameters and the
+		// form_post body
+		if err := req.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Debugf("Received callback: %s %v", req.Method, req.Form)
+		w.Header().Set("Content-Type", "text/html")
+		if !isAuthResponse(req.Form) {
+			// The response may be in the fragment
+			w.Write([]byte(loopbackRelayPage))
+			return
+		}
+		w.Write([]byte(loopbackResponsePage))
+		select {
+		case ret.result <- req.Form:
+		default:
+		}
+	})
+	ret.server = &http.Server{Handler: mux}
+	go ret.server.Serve(listener)
+	return ret, nil
+}
+
+// wait waits until the browser is redirected to the listener, and
+// returns the redirect parameters
+func (l *loopbackListener) wait(timeout time.Duration) (url.Values, error) {
+	select {
+	case values := <-l.result:
+		if e := values.Get("error"); len(e) > 0 {
+			return nil, fmt.Errorf("Authentication error: %s %s", e, values.Get("error_description"))
+		}
+		return values, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("Timed out waiting for authentication")
+	}
+}
+
+func (l *loopbackListener) close() {
+	l.server.Close()
+}
+
+// LoopbackAuth starts a listener on the callback URL, opens the
+// browser to authURL, and returns the redirected URL received by the
+// listener. If the listener cannot be started, returns nil, so the
+// user is asked to copy/paste the redirected URL
+func LoopbackAuth(authURL, callbackURL, userName string) (*url.URL, error) {
+	listener, err := newLoopbackListener(callbackURL)
+	if err != nil {
+		fmt.Printf("Cannot listen on %s: %s\n", callbackURL, err)
+		return nil, nil
+	}
+	defer listener.close()
+	if err := OpenBrowser(authURL); err != nil {
+		log.Debugf("Cannot open browser: %s", err)
+		fmt.Printf("Go to this URL to authenticate %s: %s\n", userName, authURL)
+	} else {
+		fmt.Printf("Opened browser to authenticate %s. If it did not open, go to this URL: %s\n", userName, authURL)
+	}
+	values, err := listener.wait(LoopbackTimeout)
+	if err != nil {
+		return nil, err
+	}
+	redirectedURL, _ := url.Parse(callbackURL)
+	redirectedURL.RawQuery = values.Encode()
+	return redirectedURL, nil
+}
@@ -0,0 +1,151 @@
+package oidc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bserdar/took/cfg"
+	"github.com/bserdar/took/proto"
+)
+
+func freeLoopbackURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return fmt.Sprintf("http://%s/callback", l.Addr().String())
+}
+
+func TestIsLoopbackURL(t *testing.T) {
+	for u, expected := range map[string]bool{
+		"http://127.0.0.1:8080/cb":  true,
+		"http://localhost/cb":       true,
+		"http://[::1]:9000":         true,
+		"https://127.0.0.1:8080/cb": false,
+		"http://callback":           false,
+		"http://10.0.0.1:8080":      false,
+	} {
+		if isLoopbackURL(u) != expected {
+			t.Errorf("Wrong result for %s", u)
+		}
+	}
+}
+
+func TestGetToken_Loopback(t *testing.T) {
+	handler := testProtocolHandler{response: make(map[string]testReturn)}
+	server := httptest.NewServer(&handler)
+	defer server.Close()
+
+	callback := freeLoopbackURL(t)
+	p := Protocol{}
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL},
+		ClientID:     "id",
+		ClientSecret: "secret",
+		CallbackURL:  callback}
+
+	OpenBrowser = func(authURL string) error {
+		u, err := url.Parse(authURL)
+		if err != nil {
+			return err
+		}
+		go func() {
+			resp, err := http.Get(fmt.Sprintf("%s?code=c&state=%s", callback, url.QueryEscape(u.Query().Get("state"))))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	}
+	defer func() { OpenBrowser = DefaultOpenBrowser }()
+
+	handler.response["/.well-known/openid-configuration"] =
+		testReturn{returnCode: 200, returnBody: fmt.Sprintf(`{"authorization_endpoint":"%s/auth","token_endpoint":"%s/token","token_introspection_endpoint":"%s/verify"}`, server.URL, server.URL, server.URL)}
+	handler.response["/token"] = testReturn{returnCode: 200, headers: map[string]string{"Content-Type": "application/json"}, returnBody: `{"access_token":"a","token_type":"bearer","refresh_token":"r"}`}
+
+	ret, _, err := p.GetToken(proto.TokenRequest{Username: "user"})
+	if err != nil {
+		t.Errorf("Cannot get token: %v", err)
+	}
+	if ret != "a" {
+		t.Errorf("Wrong token: %s", ret)
+	}
+
+	// Callback port is in use, the redirected URL is pasted
+	u, _ := url.Parse(callback)
+	l, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	p.Tokens = Data{}
+	asked := false
+	cfg.Ask = func(prompt string) string {
+		asked = true
+		return fmt.Sprintf("%s?code=c&state=%s", callback, url.QueryEscape(authURLParams(t, prompt).Get("state")))
+	}
+	ret, _, err = p.GetToken(proto.TokenRequest{Username: "user"})
+	if err != nil || ret != "a" || !asked {
+		t.Errorf("Expected copy/paste fallback: %s %v", ret, err)
+	}
+}
+
+func TestLoopbackFormPost(t *testing.T) {
+	callback := freeLoopbackURL(t)
+	listener, err := newLoopbackListener(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.close()
+
+	resp, err := http.PostForm(callback, url.Values{"code": {"c"}, "state": {"s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	values, err := listener.wait(LoopbackTimeout)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if values.Get("code") != "c" || values.Get("state") != "s" {
+		t.Errorf("Wrong values: %v", values)
+	}
+}
+
+func TestLoopbackFragment(t *testing.T) {
+	callback := freeLoopbackURL(t)
+	listener, err := newLoopbackListener(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.close()
+
+	// The browser does not send the fragment, the page relays it
+	resp, err := http.Get(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "location.hash") {
+		t.Errorf("Expected relay page, got %s", body)
+	}
+	resp, err = http.Get(callback + "?access_token=a&state=s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	values, err := listener.wait(LoopbackTimeout)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if values.Get("access_token") != "a" || values.Get("state") != "s" {
+		t.Errorf("Wrong values: %v", values)
+	}
+}
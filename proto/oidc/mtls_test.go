@@ -0,0 +1,88 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bserdar/took/proto"
+)
+
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:     pkix.Name{CommonName: "took"},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestGetToken_MTLS(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	defer func() {
+		proto.ClientCertificates = nil
+		proto.RootCAs = nil
+	}()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"token_endpoint":"%s/token","mtls_endpoint_aliases":{"token_endpoint":"%s/mtls/token"}}`, server.URL, server.URL)
+	})
+	mux.HandleFunc("/mtls/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if len(req.TLS.PeerCertificates) == 0 || req.Form.Get("client_id") != "id" {
+			t.Errorf("Wrong client authentication: %v", req.Form)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"a","token_type":"bearer"}`))
+	})
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	certFile, keyFile := writeClientCert(t, dir)
+
+	p := Protocol{}
+	tr := true
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL, ClientCredentials: &tr, CABundle: caFile},
+		ClientID:                "id",
+		TokenEndpointAuthMethod: TLSClientAuth,
+		ClientCert:              certFile,
+		ClientCertKey:           keyFile}
+
+	ret, _, err := p.GetToken(proto.TokenRequest{})
+	if err != nil {
+		t.Errorf("Cannot get token: %v", err)
+	}
+	if ret != "a" {
+		t.Errorf("Wrong token: %s", ret)
+	}
+}
@@ -0,0 +1,48 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// PKCE modes
+const (
+	// PKCEAllow uses PKCE if the server advertises S256 support. This is the default
+	PKCEAllow = "allow"
+	// PKCEForce always uses PKCE
+	PKCEForce = "force"
+	// PKCEDisable never uses PKCE
+	PKCEDisable = "disable"
+)
+
+const pkceMethodS256 = "S256"
+
+// pkceVerifierLength is the number of random bytes in a code
+// verifier. 32 bytes result in a 43-character verifier
+const pkceVerifierLength = 32
+
+// usePKCE decides whether PKCE should be used based on the configured
+// mode and the server capabilities
+func usePKCE(mode string, serverData ServerData) (bool, error) {
+	switch mode {
+	case PKCEForce:
+		return true, nil
+	case PKCEDisable:
+		return false, nil
+	case PKCEAllow, "":
+		for _, m := range serverData.CodeChallengeMethodsSupported {
+			if m == pkceMethodS256 {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("Invalid PKCE mode: %s Use '%s', '%s', or '%s'", mode, PKCEAllow, PKCEForce, PKCEDisable)
+}
+
+// pkceChallenge returns the S256 code challenge for the verifier
+func pkceChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
@@ -0,0 +1,98 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bserdar/took/cfg"
+	"github.com/bserdar/took/proto"
+)
+
+func TestPKCEChallenge(t *testing.T) {
+	// RFC 7636, Appendix B
+	if c := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); c != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("Wrong challenge: %s", c)
+	}
+	v, err := randomString(pkceVerifierLength)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(v) != 43 || strings.ContainsAny(v, "+/=") {
+		t.Errorf("Invalid verifier: %s", v)
+	}
+}
+
+func TestUsePKCE(t *testing.T) {
+	s256 := ServerData{CodeChallengeMethodsSupported: []string{"plain", "S256"}}
+	for _, x := range []struct {
+		mode     string
+		server   ServerData
+		expected bool
+	}{
+		{"", ServerData{}, false},
+		{"", s256, true},
+		{PKCEAllow, s256, true},
+		{PKCEForce, ServerData{}, true},
+		{PKCEDisable, s256, false},
+	} {
+		b, err := usePKCE(x.mode, x.server)
+		if err != nil || b != x.expected {
+			t.Errorf("Wrong result for %+v: %v %v", x, b, err)
+		}
+	}
+	if _, err := usePKCE("x", s256); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestGetToken_PKCE(t *testing.T) {
+	var challenge string
+	var verified bool
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"authorization_endpoint":"%s/auth","token_endpoint":"%s/token","code_challenge_methods_supported":["S256"]}`, server.URL, server.URL)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		verified = pkceChallenge(req.Form.Get("code_verifier")) == challenge
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"a","token_type":"bearer","refresh_token":"r"}`))
+	})
+
+	p := Protocol{}
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL},
+		ClientID:    "id",
+		CallbackURL: "http://callback"}
+
+	cfg.Ask = func(s string) string {
+		ix := strings.Index(s, "http://")
+		lf := strings.IndexRune(s, '\n')
+		u, err := url.Parse(s[ix:lf])
+		if err != nil {
+			t.Errorf("Cannot parse url %s: %v", s[ix:lf], err)
+			return ""
+		}
+		if u.Query().Get("code_challenge_method") != "S256" {
+			t.Errorf("Wrong challenge method: %s", u)
+		}
+		challenge = u.Query().Get("code_challenge")
+		return fmt.Sprintf("http://callback?code=c&state=%s", url.QueryEscape(u.Query().Get("state")))
+	}
+
+	ret, _, err := p.GetToken(proto.TokenRequest{Username: "user"})
+	if err != nil {
+		t.Errorf("Cannot get token: %v", err)
+	}
+	if ret != "a" {
+		t.Errorf("Wrong token: %s", ret)
+	}
+	if !verified {
+		t.Errorf("Code verifier does not match challenge")
+	}
+}
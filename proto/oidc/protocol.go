@@ -1,12 +1,10 @@
 package oidc
 
 import (
-	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	"net/http"
-	"net/url"
 	"strings"
 	"time"
 
@@ -20,10 +18,24 @@ import (
 
 const stateRandomLength = 32
 
+// DefaultRefreshSkew is how long before its expiration a token is refreshed
+const DefaultRefreshSkew = 30 * time.Second
+
+// randomString returns a URL-safe encoding of n random bytes
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 // Data contains the tokens
 type Data struct {
 	Last   string
 	Tokens []TokenData
+	// Sessions are the login sessions of form authentication
+	Sessions []LoginSession
 }
 
 // TokenData contains the access and refresh token with username
@@ -32,6 +44,77 @@ type TokenData struct {
 	AccessToken  string
 	RefreshToken string
 	Type         string
+	// Expiry, RefreshExpiry, and IssuedAt are unix times. Expiry
+	// and RefreshExpiry are 0 if the server did not send them
+	Expiry        int64
+	RefreshExpiry int64
+	IssuedAt      int64
+	// Scopes are the granted scopes, if the server sent them
+	Scopes  []string
+	IDToken string
+	// RequestScopes is the sorted set of scopes requested for this
+	// token, or empty if the token was requested with the scopes of
+	// the configuration
+	RequestScopes []string
+	// Resource and Audience are the target the token was requested
+	// for. Tokens are stored by username, RequestScopes, and target
+	Resource string
+	Audience string
+}
+
+// setToken stores the token response received at time now. If
+// refresh is true, the values not included in a refresh response
+// are kept
+func (t *TokenData) setToken(token oauth2.Token, now time.Time, refresh bool) {
+	t.AccessToken = token.AccessToken
+	t.Type = token.TokenType
+	t.IssuedAt = now.Unix()
+	t.Expiry = 0
+	if !token.Expiry.IsZero() {
+		t.Expiry = token.Expiry.Unix()
+	}
+	if !refresh || len(token.RefreshToken) > 0 {
+		t.RefreshToken = token.RefreshToken
+		t.RefreshExpiry = 0
+		if n, ok := token.Extra("refresh_expires_in").(int64); ok {
+			t.RefreshExpiry = now.Unix() + n
+		}
+	}
+	if scope, _ := token.Extra("scope").(string); len(scope) > 0 {
+		t.Scopes = strings.Fields(scope)
+	} else if !refresh {
+		t.Scopes = nil
+	}
+	if idToken, _ := token.Extra("id_token").(string); len(idToken) > 0 || !refresh {
+		t.IDToken = idToken
+	}
+}
+
+// expiry returns the access token expiration. If the token response
+// did not include it, the exp claim of a JWT access token is used
+func (t TokenData) expiry() (time.Time, bool) {
+	if t.Expiry != 0 {
+		return time.Unix(t.Expiry, 0), true
+	}
+	tok, err := jwt.ParseSigned(t.AccessToken)
+	if err == nil {
+		var c jwt.Claims
+		if tok.UnsafeClaimsWithoutVerification(&c) == nil && c.Expiry != nil {
+			return c.Expiry.Time(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Expired returns true if the access token is known to be expired at time now
+func (t TokenData) Expired(now time.Time) bool {
+	exp, ok := t.expiry()
+	return ok && !now.Before(exp)
+}
+
+// RefreshExpired returns true if the refresh token is known to be expired at time now
+func (t TokenData) RefreshExpired(now time.Time) bool {
+	return t.RefreshExpiry != 0 && now.Unix() >= t.RefreshExpiry
 }
 
 // Protocol contains the oidc config, default congfig, and tokens
@@ -54,7 +137,7 @@ func (d Data) findUser(username string) *TokenData {
 func (p *Protocol) DecodeCfg(in interface{}) (interface{}, error) {
 	if in != nil {
 		out := Config{}
-		cfg.Decode(in, &out)
+		decodeConfig(in, &out)
 		return out, nil
 	}
 	return nil, nil
@@ -63,13 +146,13 @@ func (p *Protocol) DecodeCfg(in interface{}) (interface{}, error) {
 // SetCfg sets the p.Cfg and p.Defaults from user and common configs
 func (p *Protocol) SetCfg(user, common cfg.Remote) {
 	if user.Configuration != nil {
-		cfg.Decode(user.Configuration, &p.Cfg)
+		decodeConfig(user.Configuration, &p.Cfg)
 	}
 	if user.Data != nil {
 		cfg.Decode(user.Data, &p.Tokens)
 	}
 	if common.Configuration != nil {
-		cfg.Decode(common.Configuration, &p.Defaults)
+		decodeConfig(common.Configuration, &p.Defaults)
 	}
 }
 
@@ -84,7 +167,7 @@ func (p *Protocol) GetConfig() Config {
 			panic("Server profile is not for oidc")
 		}
 		sp := ServerProfile{}
-		cfg.Decode(profile.Configuration, &sp)
+		decodeConfig(profile.Configuration, &sp)
 		ret.ServerProfile = ret.ServerProfile.Merge(sp)
 	}
 	ret = ret.Merge(p.Defaults)
@@ -110,87 +193,161 @@ func (t TokenData) FormatToken(out proto.OutputOption) string {
 	return t.AccessToken
 }
 
+// formatRequest returns the access token, or the ID token if
+// requested, based on the output options
+func (t TokenData) formatRequest(request proto.TokenRequest) string {
+	if request.IDToken {
+		return TokenData{AccessToken: t.IDToken, Type: "Bearer"}.FormatToken(request.Out)
+	}
+	return t.FormatToken(request.Out)
+}
+
+// usable returns true if the token can be returned for the request
+// without refreshing
+func (p *Protocol) usable(tok TokenData, window time.Duration, request proto.TokenRequest) bool {
+	if p.TooClose(tok, window) {
+		log.Debug("Token expiration is too close")
+		return false
+	}
+	if !tok.audienceMatches() {
+		log.Debug("Token audience does not match")
+		return false
+	}
+	if request.IDToken && !tok.idTokenUsable(window, time.Now()) {
+		log.Debug("ID token is missing or its expiration is too close")
+		return false
+	}
+	return true
+}
+
 // GetToken gets a token
 func (p *Protocol) GetToken(request proto.TokenRequest) (string, interface{}, error) {
 	config := p.GetConfig()
 	if config.Insecure {
 		proto.InsecureTLS = true
 	}
-	// If there is a username, use that. Otherwise, use last
-	userName := request.Username
-	if userName == "" {
-		userName = p.Tokens.Last
+	if err := setupTLS(config); err != nil {
+		return "", nil, err
 	}
+	clientCredentials := config.ClientCredentials != nil && *config.ClientCredentials
+	// If there is a username, use that. Otherwise, use last. Client
+	// credentials tokens do not have a username. Exchanged tokens
+	// use the username of the subject remote, which may be empty
+	var userName string
+	if !clientCredentials {
+		userName = request.Username
+		if userName == "" {
+			userName = p.Tokens.Last
+		}
 
-	if userName == "" {
-		log.Fatalf("Username is required for oidc auth")
-		return "", nil, nil
+		if userName == "" && config.TokenExchange == nil {
+			log.Fatalf("Username is required for oidc auth")
+			return "", nil, nil
+		}
 	}
+	requested := scopeSet(request.Scopes)
+	target := requestTarget(config, request)
 	var tok *TokenData
-	tok = p.Tokens.findUser(userName)
+	tok = p.Tokens.findToken(userName, requested, target)
 	if tok == nil {
 		p.Tokens.Tokens = append(p.Tokens.Tokens, TokenData{})
 		tok = &p.Tokens.Tokens[len(p.Tokens.Tokens)-1]
 		tok.Username = userName
+		tok.RequestScopes = requested
+		tok.Resource = target.Resource
+		tok.Audience = target.Audience
+	}
+	if !clientCredentials {
+		p.Tokens.Last = tok.Username
 	}
-	p.Tokens.Last = tok.Username
 
-	serverData, err := GetServerData(config.URL)
+	serverData, err := getServerData(config)
+	if err != nil {
+		return "", nil, err
+	}
+	window, err := refreshWindow(config, request)
 	if err != nil {
 		return "", nil, err
 	}
 	if request.Refresh != proto.UseReAuth {
+		if tok.AccessToken == "" && request.IDToken && tok.IDToken != "" {
+			// id_token response type returns only the ID token, which
+			// is verified when it is received
+			if p.usable(*tok, window, request) && request.Refresh != proto.UseRefresh {
+				return tok.formatRequest(request), p.Tokens, nil
+			}
+		}
 		if tok.AccessToken != "" {
-			log.Debugf("There is an access token, validating")
-			if p.Validate(tok.AccessToken, serverData) {
-				log.Debug("Token is valid")
-				// Token may be valid, but too close to expiration
-				if !p.TooClose(tok.AccessToken, serverData) {
-					log.Debug("But expiration is too close")
-					if request.Refresh != proto.UseRefresh {
-						return tok.FormatToken(request.Out), p.Tokens, nil
+			if tok.Expired(time.Now()) {
+				log.Debug("Access token is expired")
+			} else {
+				log.Debugf("There is an access token, validating")
+				if p.Validate(*tok, serverData) {
+					log.Debug("Token is valid")
+					// Token may be valid, but not usable for this request
+					if p.usable(*tok, window, request) {
+						if request.Refresh != proto.UseRefresh {
+							return tok.formatRequest(request), p.Tokens, nil
+						}
 					}
 				}
 			}
-			if tok.RefreshToken != "" {
+			if tok.RefreshToken != "" && tok.RefreshExpired(time.Now()) {
+				log.Debug("Refresh token is expired")
+			} else if tok.RefreshToken != "" {
 				log.Debug("Refreshing token")
 				err := p.Refresh(tok, serverData)
 				if err == nil {
-					return tok.FormatToken(request.Out), p.Tokens, nil
+					if p.usable(*tok, window, request) {
+						return tok.formatRequest(request), p.Tokens, nil
+					}
+					log.Debug("Refreshed token is not usable, authenticating")
 				}
 			}
 		}
+		if len(requested) > 0 && request.Refresh != proto.UseRefresh && p.fromCoveringToken(tok, serverData, window) {
+			if p.usable(*tok, window, request) {
+				return tok.formatRequest(request), p.Tokens, nil
+			}
+		}
 	}
 
-	conf := &oauth2.Config{
-		ClientID:     config.ClientID,
-		ClientSecret: config.ClientSecret,
-		Scopes:       []string{"openid"},
-		RedirectURL:  config.CallbackURL,
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  p.GetAuthURL(serverData),
-			TokenURL: p.GetTokenURL(serverData)}}
-
-	// Generate a crytographically secure random token for the state.
-	stateBytes := make([]byte, stateRandomLength)
-	_, err = rand.Read(stateBytes)
-	if err != nil {
-		return "", nil, err
-	}
-	state := base64.URLEncoding.EncodeToString(stateBytes)
-
-	var token *oauth2.Token
-	ctx := context.Background()
-	ctx = context.WithValue(ctx, oauth2.HTTPClient, proto.GetHTTPClient())
-	conf.Scopes = append(conf.Scopes, config.AdditionalScopes...)
+	auth := p.clientAuth(serverData)
+	tokenURL := p.GetTokenURL(serverData)
+	scopes := requestScopes(config, requested)
+	var token oauth2.Token
+	var nonce string
 	log.Debugf("Password grant: %v", config.PasswordGrant)
-	if config.RefreshOnly != nil && *config.RefreshOnly {
+	if config.TokenExchange != nil {
+		x := *config.TokenExchange
+		if len(requested) > 0 {
+			x.Scopes = requested
+		}
+		x.Resource = wdef(target.Resource, x.Resource)
+		x.Audience = wdef(target.Audience, x.Audience)
+		token, err = ExchangeToken(auth, x, userName, tokenURL)
+	} else if clientCredentials {
+		ccScopes := config.AdditionalScopes
+		if len(requested) > 0 {
+			ccScopes = requested
+		}
+		token, err = ClientCredentialsToken(auth, ccScopes, target, tokenURL)
+	} else if config.RefreshOnly != nil && *config.RefreshOnly {
 		tok.RefreshToken = cfg.AskPasswordWithPrompt(fmt.Sprintf("Refresh token for %s: ", userName))
+		tok.RefreshExpiry = 0
 		err := p.Refresh(tok, serverData)
 		if err != nil {
 			return "", nil, err
 		}
-		return tok.FormatToken(request.Out), p.Tokens, nil
+		if err := p.checkMinValid(*tok, request.MinValid); err != nil {
+			return "", nil, err
+		}
+		if request.IDToken && len(tok.IDToken) == 0 {
+			return "", nil, fmt.Errorf("Server did not return an ID token")
+		}
+		return tok.formatRequest(request), p.Tokens, nil
+	} else if config.DeviceGrant != nil && *config.DeviceGrant {
+		token, err = DeviceAuth(auth, scopes, target, serverData.DeviceAuthorizationEndpoint, tokenURL, userName)
 	} else if config.PasswordGrant != nil && *config.PasswordGrant {
 		var password string
 		if len(request.Password) > 0 {
@@ -198,53 +355,64 @@ func (p *Protocol) GetToken(request proto.TokenRequest) (string, interface{}, er
 		} else {
 			password = cfg.AskPasswordWithPrompt(fmt.Sprintf("Password for %s: ", userName))
 		}
-		token, err = conf.PasswordCredentialsToken(ctx, userName, password)
-		if err != nil {
-			return "", nil, err
-		}
+		token, err = PasswordToken(auth, userName, password, scopes, target, tokenURL)
 	} else {
-		authURL := conf.AuthCodeURL(state, oauth2.AccessTypeOnline)
-		var redirectedURL *url.URL
-		if config.Form != nil {
-			redirectedURL = FormAuth(*config.Form, authURL, userName, request.Password)
-			if redirectedURL == nil {
-				fmt.Printf("Authentication failed\n")
-			}
+		if !request.IDToken && isIDTokenOnly(config.ResponseType) {
+			return "", nil, fmt.Errorf("Response type %s does not return an access token, use took idtoken", config.ResponseType)
 		}
-		if redirectedURL == nil {
-			inURL := cfg.Ask(fmt.Sprintf(`Go to this URL to authenticate %s: %s
-After authentication, copy/paste the URL here:`, userName, authURL))
-			redirectedURL, err = url.Parse(inURL)
-			if err != nil {
-				return "", nil, err
-			}
-			if state != redirectedURL.Query().Get("state") {
-				return "", nil, fmt.Errorf("Invalid state")
-			}
-		}
-		token, err = conf.Exchange(ctx, redirectedURL.Query().Get("code"))
-		if err != nil {
-			return "", nil, err
+		nonce, err = randomString(nonceRandomLength)
+		if err == nil {
+			token, err = p.authCodeFlow(config, serverData, auth, scopes, target, userName, request.Password, nonce)
 		}
 	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := verifyTokenResponse(token, serverData, auth, nonce); err != nil {
+		return "", nil, err
+	}
+	tok.setToken(token, time.Now(), false)
+	if err := p.checkMinValid(*tok, request.MinValid); err != nil {
+		return "", nil, err
+	}
+	if request.IDToken && len(tok.IDToken) == 0 {
+		return "", nil, fmt.Errorf("Server did not return an ID token")
+	}
+	if !request.IDToken && len(tok.AccessToken) == 0 {
+		return "", nil, fmt.Errorf("Server did not return an access token")
+	}
 
-	tok.AccessToken = token.AccessToken
-	tok.RefreshToken = token.RefreshToken
-	tok.Type = token.TokenType
+	return tok.formatRequest(request), p.Tokens, nil
+}
 
-	return tok.FormatToken(request.Out), p.Tokens, nil
+// verifyTokenResponse verifies the ID token in the token response, if there is one
+func verifyTokenResponse(token oauth2.Token, serverData ServerData, auth ClientAuth, nonce string) error {
+	idToken, _ := token.Extra("id_token").(string)
+	if len(idToken) == 0 {
+		return nil
+	}
+	if err := VerifyIDToken(idToken, serverData, auth, nonce, token.AccessToken, time.Now()); err != nil {
+		return fmt.Errorf("Invalid ID token: %s", err)
+	}
+	return nil
 }
 
 // Refresh refreshes the token
 func (p *Protocol) Refresh(tok *TokenData, s ServerData) error {
-	cfg := p.GetConfig()
-	t, err := RefreshToken(cfg.ClientID, cfg.ClientSecret, tok.RefreshToken, p.GetTokenURL(s))
+	auth := p.clientAuth(s)
+	var scopes []string
+	if len(tok.RequestScopes) > 0 {
+		scopes = requestScopes(p.GetConfig(), tok.RequestScopes)
+	}
+	t, err := RefreshToken(auth, tok.RefreshToken, scopes, tok.target(), p.GetTokenURL(s))
 	if err != nil {
 		return err
 	}
-	tok.AccessToken = t.AccessToken
-	tok.RefreshToken = t.RefreshToken
-	tok.Type = t.TokenType
+	if err := verifyTokenResponse(t, s, auth, ""); err != nil {
+		return err
+	}
+	tok.setToken(t, time.Now(), true)
 	return nil
 }
 
@@ -266,7 +434,12 @@ func (p *Protocol) GetAuthURL(s ServerData) string {
 	return combine(cfg.URL, cfg.AuthAPI)
 }
 
+// combine appends suffix to the base URL. If suffix is an absolute
+// URL, it is returned as is
 func combine(base, suffix string) string {
+	if strings.Contains(suffix, "://") {
+		return suffix
+	}
 	if strings.HasPrefix(suffix, "/") {
 		suffix = suffix[1:]
 	}
@@ -276,18 +449,43 @@ func combine(base, suffix string) string {
 	return base + suffix
 }
 
-// TooClose returns true if the token expiration is too close: 1m if
-// token lifetime is more than 1m, or token lifetime if not
-func (p *Protocol) TooClose(accessToken string, serverData ServerData) bool {
-	t, err := jwt.ParseSigned(accessToken)
-	if err == nil {
-		var c jwt.Claims
-		t.UnsafeClaimsWithoutVerification(&c)
-		return tooClose(c.Expiry.Time(), time.Now())
+// TooClose returns true if the token expires within window. If the
+// token expiration is not known, returns false
+func (p *Protocol) TooClose(tok TokenData, window time.Duration) bool {
+	if exp, ok := tok.expiry(); ok {
+		return tooClose(exp, time.Now(), window)
 	}
 	return false
 }
 
-func tooClose(expiry, now time.Time) bool {
-	return expiry.Sub(now) < 30*time.Second
+func tooClose(expiry, now time.Time, window time.Duration) bool {
+	return expiry.Sub(now) < window
+}
+
+// refreshWindow returns how long a token must remain valid to be
+// used without refreshing: the larger of the refresh skew of the
+// configuration and the requested minimum validity
+func refreshWindow(config Config, request proto.TokenRequest) (time.Duration, error) {
+	window := DefaultRefreshSkew
+	if len(config.RefreshSkew) > 0 {
+		skew, err := time.ParseDuration(config.RefreshSkew)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid refresh skew %s: %s", config.RefreshSkew, err)
+		}
+		window = skew
+	}
+	if request.MinValid > window {
+		window = request.MinValid
+	}
+	return window, nil
+}
+
+// checkMinValid returns an error if a new token does not remain
+// valid for the requested minimum duration
+func (p *Protocol) checkMinValid(tok TokenData, minValid time.Duration) error {
+	if minValid > 0 && p.TooClose(tok, minValid) {
+		exp, _ := tok.expiry()
+		return fmt.Errorf("Token expires at %s, it cannot be valid for %s", exp.Format(time.RFC3339), minValid)
+	}
+	return nil
 }
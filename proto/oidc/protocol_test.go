@@ -1,6 +1,7 @@
 package oidc
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -9,6 +10,8 @@ import (
 	"testing"
 	"time"
 
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+
 	"github.com/bserdar/took/cfg"
 	"github.com/bserdar/took/proto"
 )
@@ -65,6 +68,46 @@ func TestGetToken_PasswordGrant(t *testing.T) {
 	}
 }
 
+func TestGetToken_PasswordGrantNoDiscovery(t *testing.T) {
+	handler := testProtocolHandler{response: make(map[string]testReturn)}
+	server := httptest.NewServer(&handler)
+	defer server.Close()
+	ks := newTestKeyServer(t)
+	defer ks.server.Close()
+
+	p := Protocol{}
+	tr := true
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL, PasswordGrant: &tr, NoDiscovery: true, TokenAPI: "token"},
+		ClientID:     "id",
+		ClientSecret: "secret"}
+
+	idToken := ks.sign(t, jwt.Claims{Audience: jwt.Audience{"id"},
+		Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	cfg.AskPasswordWithPrompt = func(s string) string { return "pwd" }
+	handler.response["/token"] = testReturn{returnCode: 200, headers: map[string]string{"Content-Type": "application/json"},
+		returnBody: fmt.Sprintf(`{"access_token":"a","token_type":"bearer","refresh_token":"r","expires_in":300,"id_token":"%s"}`, idToken)}
+
+	// ID token signature cannot be verified without the server keys
+	if _, _, err := p.GetToken(proto.TokenRequest{Username: "user"}); err == nil || !strings.Contains(err.Error(), "--jwks-api") {
+		t.Errorf("Expected error without server keys: %v", err)
+	}
+
+	p.Cfg.JWKSAPI = ks.server.URL + "/keys"
+	ret, _, err := p.GetToken(proto.TokenRequest{Username: "user"})
+	if err != nil || ret != "a" {
+		t.Errorf("Cannot get token: %s %v", ret, err)
+	}
+
+	// Claims are still checked
+	idToken = ks.sign(t, jwt.Claims{Audience: jwt.Audience{"other"},
+		Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	handler.response["/token"] = testReturn{returnCode: 200, headers: map[string]string{"Content-Type": "application/json"},
+		returnBody: fmt.Sprintf(`{"access_token":"b","token_type":"bearer","id_token":"%s"}`, idToken)}
+	if _, _, err := p.GetToken(proto.TokenRequest{Username: "other"}); err == nil {
+		t.Errorf("ID token with wrong audience should be rejected")
+	}
+}
+
 func TestGetToken(t *testing.T) {
 	handler := testProtocolHandler{response: make(map[string]testReturn)}
 	server := httptest.NewServer(&handler)
@@ -202,17 +245,198 @@ func TestRefreshNeeded(t *testing.T) {
 func TestTooClose(t *testing.T) {
 	// Expired already
 	if !tooClose(time.Date(2000, time.November, 2, 1, 2, 3, 0, time.UTC),
-		time.Date(2000, time.November, 2, 1, 2, 4, 0, time.UTC)) {
+		time.Date(2000, time.November, 2, 1, 2, 4, 0, time.UTC), DefaultRefreshSkew) {
 		t.Errorf("It was expired")
 	}
 	if !tooClose(time.Date(2000, time.November, 2, 1, 2, 3, 0, time.UTC),
-		time.Date(2000, time.November, 2, 1, 2, 2, 0, time.UTC)) {
+		time.Date(2000, time.November, 2, 1, 2, 2, 0, time.UTC), DefaultRefreshSkew) {
 		t.Errorf("It was too close")
 	}
 
 	if tooClose(time.Date(2000, time.November, 2, 1, 2, 3, 0, time.UTC),
-		time.Date(2000, time.November, 2, 1, 1, 0, 0, time.UTC)) {
+		time.Date(2000, time.November, 2, 1, 1, 0, 0, time.UTC), DefaultRefreshSkew) {
 		t.Errorf("It was not too close")
 	}
 
 }
+
+func TestGetToken_ClientCredentials(t *testing.T) {
+	requests := 0
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"token_endpoint":"%s/token","token_introspection_endpoint":"%s/verify"}`, server.URL, server.URL)
+	})
+	mux.HandleFunc("/verify", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"active":false}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("grant_type") != "client_credentials" || req.Form.Get("scope") != "api" {
+			t.Errorf("Wrong token request: %v", req.Form)
+		}
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"a%d","token_type":"bearer"}`, requests)
+	})
+
+	p := Protocol{}
+	tr := true
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL, ClientCredentials: &tr, AdditionalScopes: []string{"api"}},
+		ClientID:     "id",
+		ClientSecret: "secret"}
+
+	ret, _, err := p.GetToken(proto.TokenRequest{})
+	if err != nil {
+		t.Errorf("Cannot get token: %v", err)
+	}
+	if ret != "a1" {
+		t.Errorf("Wrong token: %s", ret)
+	}
+	// Token is no longer valid, and there is no refresh token
+	ret, _, err = p.GetToken(proto.TokenRequest{})
+	if err != nil {
+		t.Errorf("Cannot get token: %v", err)
+	}
+	if ret != "a2" {
+		t.Errorf("Wrong token: %s", ret)
+	}
+	if len(p.Tokens.Tokens) != 1 || p.Tokens.Tokens[0].Username != "" {
+		t.Errorf("Wrong tokens: %+v", p.Tokens)
+	}
+}
+
+func TestTokenResponse(t *testing.T) {
+	now := time.Unix(1000, 0)
+	for _, body := range []string{`{"access_token":"a","expires_in":300,"refresh_expires_in":1800,"scope":"openid email","id_token":"i"}`,
+		`{"access_token":"a","expires_in":"300","refresh_expires_in":"1800","scope":"openid email","id_token":"i"}`} {
+		var r tokenResponse
+		if err := json.Unmarshal([]byte(body), &r); err != nil {
+			t.Fatalf("Cannot parse %s: %s", body, err)
+		}
+		var tok TokenData
+		tok.setToken(r.Token(now), now, false)
+		if tok.Expiry != 1300 || tok.RefreshExpiry != 2800 || tok.IssuedAt != 1000 ||
+			tok.IDToken != "i" || len(tok.Scopes) != 2 || tok.Scopes[1] != "email" {
+			t.Errorf("Wrong token data for %s: %+v", body, tok)
+		}
+	}
+}
+
+func TestGetToken_OpaqueExpiry(t *testing.T) {
+	handler := testProtocolHandler{response: make(map[string]testReturn)}
+	server := httptest.NewServer(&handler)
+	defer server.Close()
+
+	p := Protocol{}
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL},
+		ClientID:     "id",
+		ClientSecret: "secret",
+		CallbackURL:  "http://callback"}
+	p.Tokens = Data{Last: "last",
+		Tokens: []TokenData{{Username: "last", Type: "bearer", AccessToken: "old", RefreshToken: "r",
+			Expiry: time.Now().Add(10 * time.Second).Unix(), IDToken: "i", Scopes: []string{"openid"}}}}
+
+	handler.response["/.well-known/openid-configuration"] =
+		testReturn{returnCode: 200, returnBody: fmt.Sprintf(`{"authorization_endpoint":"%s/auth","token_endpoint":"%s/token","token_introspection_endpoint":"%s/verify"}`, server.URL, server.URL, server.URL)}
+	handler.response["/verify"] = testReturn{returnCode: 200, headers: map[string]string{"Content-Type": "application/json"}, returnBody: `{"active":true}`}
+	handler.response["/token"] = testReturn{returnCode: 200, headers: map[string]string{"Content-Type": "application/json"}, returnBody: `{"access_token":"new","token_type":"bearer","expires_in":300}`}
+
+	// Opaque token is active, but close to expiration, so it is refreshed
+	ret, _, err := p.GetToken(proto.TokenRequest{})
+	if err != nil {
+		t.Errorf("Cannot get token: %v", err)
+	}
+	if ret != "new" {
+		t.Errorf("Token is not refreshed: %s", ret)
+	}
+	tok := p.Tokens.Tokens[0]
+	if tok.RefreshToken != "r" || tok.IDToken != "i" || len(tok.Scopes) != 1 {
+		t.Errorf("Refresh response should not remove token data: %+v", tok)
+	}
+	if d := time.Until(time.Unix(tok.Expiry, 0)); d < 290*time.Second || d > 300*time.Second {
+		t.Errorf("Wrong expiry: %s", d)
+	}
+
+	// Token is fresh now
+	handler.response["/token"] = testReturn{returnCode: 500}
+	ret, _, err = p.GetToken(proto.TokenRequest{})
+	if err != nil || ret != "new" {
+		t.Errorf("Fresh token should be used: %s %v", ret, err)
+	}
+}
+
+func TestGetToken_OpaqueNoIntrospection(t *testing.T) {
+	handler := testProtocolHandler{response: make(map[string]testReturn)}
+	server := httptest.NewServer(&handler)
+	defer server.Close()
+
+	p := Protocol{}
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL},
+		ClientID:     "id",
+		ClientSecret: "secret",
+		CallbackURL:  "http://callback"}
+	p.Tokens = Data{Last: "last",
+		Tokens: []TokenData{{Username: "last", Type: "bearer", AccessToken: "old", RefreshToken: "r",
+			Expiry: time.Now().Add(time.Hour).Unix()}}}
+
+	handler.response["/.well-known/openid-configuration"] =
+		testReturn{returnCode: 200, returnBody: fmt.Sprintf(`{"authorization_endpoint":"%s/auth","token_endpoint":"%s/token"}`, server.URL, server.URL)}
+	handler.response["/token"] = testReturn{returnCode: 500}
+
+	// Token cannot be checked with the server, the expiration is used
+	for i := 0; i < 2; i++ {
+		ret, _, err := p.GetToken(proto.TokenRequest{})
+		if err != nil || ret != "old" {
+			t.Errorf("Unexpired token should be used: %s %v", ret, err)
+		}
+	}
+
+	// Token is close to expiration, so it is refreshed
+	p.Tokens.Tokens[0].Expiry = time.Now().Add(10 * time.Second).Unix()
+	handler.response["/token"] = testReturn{returnCode: 200, headers: map[string]string{"Content-Type": "application/json"}, returnBody: `{"access_token":"new","token_type":"bearer","expires_in":300}`}
+	ret, _, err := p.GetToken(proto.TokenRequest{})
+	if err != nil || ret != "new" {
+		t.Errorf("Token is not refreshed: %s %v", ret, err)
+	}
+}
+
+func TestGetToken_MinValid(t *testing.T) {
+	handler := testProtocolHandler{response: make(map[string]testReturn)}
+	server := httptest.NewServer(&handler)
+	defer server.Close()
+
+	p := Protocol{}
+	tr := true
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL, PasswordGrant: &tr, RefreshSkew: "1m"},
+		ClientID:     "id",
+		ClientSecret: "secret"}
+	p.Tokens = Data{Last: "user",
+		Tokens: []TokenData{{Username: "user", Type: "bearer", AccessToken: "old", RefreshToken: "r",
+			Expiry: time.Now().Add(5 * time.Minute).Unix()}}}
+
+	cfg.AskPasswordWithPrompt = func(s string) string { return "pwd" }
+	handler.response["/.well-known/openid-configuration"] =
+		testReturn{returnCode: 200, returnBody: fmt.Sprintf(`{"token_endpoint":"%s/token","token_introspection_endpoint":"%s/verify"}`, server.URL, server.URL)}
+	handler.response["/verify"] = testReturn{returnCode: 200, headers: map[string]string{"Content-Type": "application/json"}, returnBody: `{"active":true}`}
+	handler.response["/token"] = testReturn{returnCode: 200, headers: map[string]string{"Content-Type": "application/json"}, returnBody: `{"access_token":"new","token_type":"bearer","expires_in":300}`}
+
+	// Token is valid for 5m, more than the refresh skew
+	ret, _, err := p.GetToken(proto.TokenRequest{})
+	if err != nil || ret != "old" {
+		t.Errorf("Token should be used: %s %v", ret, err)
+	}
+
+	// New tokens are valid for 5m, less than requested
+	_, _, err = p.GetToken(proto.TokenRequest{MinValid: 10 * time.Minute})
+	if err == nil {
+		t.Errorf("Expected error")
+	}
+
+	handler.response["/token"] = testReturn{returnCode: 200, headers: map[string]string{"Content-Type": "application/json"}, returnBody: `{"access_token":"long","token_type":"bearer","expires_in":3600}`}
+	ret, _, err = p.GetToken(proto.TokenRequest{MinValid: 10 * time.Minute})
+	if err != nil || ret != "long" {
+		t.Errorf("Token should be renewed: %s %v", ret, err)
+	}
+}
@@ -1,41 +1,25 @@
 package oidc
 
 import (
-	"encoding/json"
-	"fmt"
 	"net/url"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
-
-	"github.com/bserdar/took/proto"
 )
 
-// RefreshToken gets a new token using the refresh token
-func RefreshToken(clientID, clientSecret, refreshToken, tokenURL string) (oauth2.Token, error) {
+// RefreshToken gets a new token using the refresh token. If scopes
+// is nonempty, the new token is requested with those scopes, which
+// must be granted to the refresh token. The target is sent as the
+// resource and audience of the new token
+func RefreshToken(auth ClientAuth, refreshToken string, scopes []string, target Target, tokenURL string) (oauth2.Token, error) {
 	values := url.Values{}
-	values.Set("client_id", clientID)
-	if len(clientSecret) > 0 {
-		values.Set("client_secret", clientSecret)
-	}
 	values.Set("refresh_token", refreshToken)
 	values.Set("grant_type", "refresh_token")
-	log.Debugf("Refresh %s %v", tokenURL, values)
-	resp, err := proto.HTTPPostForm(tokenURL, values)
-	if err != nil {
-		log.Debugf("Refresh token returns: %s", err)
-		return oauth2.Token{}, err
-	}
-	if resp.StatusCode != 200 {
-		log.Debugf("Refresh token returns: %s", resp.Status)
-		return oauth2.Token{}, fmt.Errorf("Cannot refresh token: %s", resp.Status)
-	}
-	defer resp.Body.Close()
-	var d oauth2.Token
-	err = json.NewDecoder(resp.Body).Decode(&d)
-	if err != nil {
-		return oauth2.Token{}, err
+	if len(scopes) > 0 {
+		values.Set("scope", strings.Join(scopes, " "))
 	}
-	log.Debugf("Tokens: %v", d)
-	return d, nil
+	target.setValues(values)
+	log.Debugf("Refresh %s", tokenURL)
+	return postTokenRequest(auth, tokenURL, values)
 }
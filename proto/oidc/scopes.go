@@ -0,0 +1,140 @@
+package oidc
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// scopeSet returns the sorted scopes without duplicates or empty
+// scopes. Returns nil if there are no scopes
+func scopeSet(scopes []string) []string {
+	var ret []string
+	seen := map[string]bool{}
+	for _, s := range scopes {
+		if len(s) > 0 && !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func sameScopes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// requestScopes returns the scopes to send in an authorization
+// request: openid, followed by the requested scopes, or the
+// additional scopes of the configuration if there are no requested
+// scopes
+func requestScopes(config Config, requested []string) []string {
+	if len(requested) == 0 {
+		requested = config.AdditionalScopes
+	}
+	ret := []string{"openid"}
+	for _, s := range requested {
+		if s != "openid" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// covers returns true if the token was granted all the scopes. If
+// the server did not return the granted scopes, the requested
+// scopes of the token are used
+func (t TokenData) covers(scopes []string) bool {
+	granted := t.Scopes
+	if len(granted) == 0 {
+		granted = t.RequestScopes
+	}
+	if len(granted) == 0 {
+		return false
+	}
+	for _, s := range scopes {
+		found := false
+		for _, g := range granted {
+			if g == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// findToken returns the token for the user requested with the scope set and target
+func (d Data) findToken(username string, scopes []string, target Target) *TokenData {
+	for i, x := range d.Tokens {
+		if x.Username == username && sameScopes(x.RequestScopes, scopes) && x.target() == target {
+			return &d.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// fromCoveringToken sets tok, requested with a scope set, using
+// another token of the same user and target that covers the
+// scopes. If that token is usable, it is copied. Otherwise, if it has
+// a refresh token, a token with the requested scopes is obtained by
+// refreshing it with a narrower scope. The refresh token is kept only
+// with the covering token. Returns false if there is no such token
+func (p *Protocol) fromCoveringToken(tok *TokenData, serverData ServerData, window time.Duration) bool {
+	for i := range p.Tokens.Tokens {
+		src := &p.Tokens.Tokens[i]
+		if src == tok || src.Username != tok.Username || src.target() != tok.target() || !src.covers(tok.RequestScopes) {
+			continue
+		}
+		if len(src.AccessToken) > 0 && !src.Expired(time.Now()) && !p.TooClose(*src, window) &&
+			p.Validate(*src, serverData) {
+			log.Debugf("Using token with scopes %v", src.Scopes)
+			requested := tok.RequestScopes
+			*tok = *src
+			tok.RequestScopes = requested
+			tok.RefreshToken = ""
+			tok.RefreshExpiry = 0
+			return true
+		}
+	}
+	for i := range p.Tokens.Tokens {
+		src := &p.Tokens.Tokens[i]
+		if src == tok || src.Username != tok.Username || src.target() != tok.target() || len(src.RefreshToken) == 0 ||
+			src.RefreshExpired(time.Now()) || !src.covers(tok.RequestScopes) {
+			continue
+		}
+		log.Debugf("Downscoping token with scopes %v to %v", src.Scopes, tok.RequestScopes)
+		auth := p.clientAuth(serverData)
+		t, err := RefreshToken(auth, src.RefreshToken, requestScopes(p.GetConfig(), tok.RequestScopes), tok.target(), p.GetTokenURL(serverData))
+		if err == nil {
+			err = verifyTokenResponse(t, serverData, auth, "")
+		}
+		if err != nil {
+			log.Debugf("Cannot downscope: %s", err)
+			continue
+		}
+		tok.setToken(t, time.Now(), false)
+		// The new refresh token, if any, replaces the refresh token of the covering token
+		if len(tok.RefreshToken) > 0 {
+			src.RefreshToken = tok.RefreshToken
+			src.RefreshExpiry = tok.RefreshExpiry
+		}
+		tok.RefreshToken = ""
+		tok.RefreshExpiry = 0
+		return true
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bserdar/took/cfg"
+	"github.com/bserdar/took/proto"
+)
+
+func TestScopeSet(t *testing.T) {
+	s := scopeSet([]string{"b", "a", "", "b"})
+	if !sameScopes(s, []string{"a", "b"}) {
+		t.Errorf("Wrong scope set: %v", s)
+	}
+	if scopeSet(nil) != nil {
+		t.Errorf("Empty scope set should be nil")
+	}
+	tok := TokenData{Scopes: []string{"openid", "read", "write"}}
+	if !tok.covers([]string{"read"}) || tok.covers([]string{"read", "admin"}) {
+		t.Errorf("Wrong covers")
+	}
+}
+
+func TestGetToken_Scopes(t *testing.T) {
+	var requests []string
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"token_endpoint":"%s/token","token_introspection_endpoint":"%s/verify"}`, server.URL, server.URL)
+	})
+	mux.HandleFunc("/verify", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"active":true}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		requests = append(requests, req.Form.Get("grant_type")+":"+req.Form.Get("scope"))
+		w.Header().Set("Content-Type", "application/json")
+		switch req.Form.Get("grant_type") {
+		case "refresh_token":
+			fmt.Fprintf(w, `{"access_token":"narrow","token_type":"bearer","refresh_token":"r2","expires_in":300,"scope":"%s"}`, req.Form.Get("scope"))
+		case "password":
+			fmt.Fprintf(w, `{"access_token":"admin","token_type":"bearer","refresh_token":"r3","expires_in":300,"scope":"%s"}`, req.Form.Get("scope"))
+		}
+	})
+
+	p := Protocol{}
+	tr := true
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL, PasswordGrant: &tr},
+		ClientID: "id"}
+	p.Tokens = Data{Last: "user",
+		Tokens: []TokenData{{Username: "user", Type: "bearer", AccessToken: "full", RefreshToken: "r",
+			Expiry: time.Now().Add(-time.Minute).Unix(), Scopes: []string{"openid", "read", "write"}}}}
+	cfg.AskPasswordWithPrompt = func(s string) string { return "pwd" }
+
+	// Downscoped using the refresh token of the full token
+	ret, _, err := p.GetToken(proto.TokenRequest{Scopes: []string{"read"}})
+	if err != nil || ret != "narrow" {
+		t.Fatalf("Wrong token: %s %v", ret, err)
+	}
+	if len(requests) != 1 || requests[0] != "refresh_token:openid read" {
+		t.Errorf("Wrong requests: %v", requests)
+	}
+	if len(p.Tokens.Tokens) != 2 || p.Tokens.Tokens[0].RefreshToken != "r2" || p.Tokens.Tokens[1].RefreshToken != "" {
+		t.Errorf("Wrong tokens: %+v", p.Tokens.Tokens)
+	}
+
+	// Cached
+	ret, _, _ = p.GetToken(proto.TokenRequest{Scopes: []string{"read", "read"}})
+	if ret != "narrow" || len(requests) != 1 {
+		t.Errorf("Cached token is not used: %s %v", ret, requests)
+	}
+
+	// Not covered, so authenticate
+	ret, _, _ = p.GetToken(proto.TokenRequest{Scopes: []string{"admin"}})
+	if ret != "admin" || len(requests) != 2 || requests[1] != "password:openid admin" {
+		t.Errorf("Wrong token: %s %v", ret, requests)
+	}
+	if len(p.Tokens.Tokens) != 3 {
+		t.Errorf("Wrong tokens: %+v", p.Tokens.Tokens)
+	}
+}
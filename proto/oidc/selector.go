@@ -0,0 +1,187 @@
+package oidc
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// simpleSelector is a compound CSS selector: an optional tag name,
+// id, classes, and attributes, like div#error.alert[role=alert]
+type simpleSelector struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   map[string]*string
+}
+
+// Selector is a subset of CSS selectors: comma separated alternatives
+// of simple selectors combined with the descendant combinator
+type Selector [][]simpleSelector
+
+// ParseSelector parses a selector like "div.alert-error span,
+// #input-error". Only tag names, #id, .class, [attr], and [attr=value]
+// are supported
+func ParseSelector(s string) (Selector, error) {
+	var ret Selector
+	for _, alt := range strings.Split(s, ",") {
+		var seq []simpleSelector
+		for _, part := range strings.Fields(alt) {
+			sel, err := parseSimpleSelector(part)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, sel)
+		}
+		if len(seq) == 0 {
+			return nil, fmt.Errorf("Invalid selector: %s", s)
+		}
+		ret = append(ret, seq)
+	}
+	return ret, nil
+}
+
+// isIdent returns true if s is a nonempty name of letters, digits, - and _
+func isIdent(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func parseSimpleSelector(s string) (simpleSelector, error) {
+	var sel simpleSelector
+	// name returns the identifier at the beginning of s
+	name := func(s string) string {
+		i := strings.IndexAny(s, "#.[")
+		if i == -1 {
+			return s
+		}
+		return s[:i]
+	}
+	sel.tag = strings.ToLower(name(s))
+	s = s[len(sel.tag):]
+	if sel.tag == "*" {
+		sel.tag = ""
+	} else if len(sel.tag) > 0 && !isIdent(sel.tag) {
+		return sel, fmt.Errorf("Invalid selector: %s", sel.tag)
+	}
+	for len(s) > 0 {
+		switch s[0] {
+		case '#':
+			sel.id = name(s[1:])
+			if !isIdent(sel.id) {
+				return sel, fmt.Errorf("Invalid selector: %s", s)
+			}
+			s = s[1+len(sel.id):]
+		case '.':
+			c := name(s[1:])
+			if !isIdent(c) {
+				return sel, fmt.Errorf("Invalid selector: %s", s)
+			}
+			sel.classes = append(sel.classes, c)
+			s = s[1+len(c):]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end == -1 {
+				return sel, fmt.Errorf("Invalid selector: %s", s)
+			}
+			if sel.attrs == nil {
+				sel.attrs = map[string]*string{}
+			}
+			attr := s[1:end]
+			if eq := strings.IndexByte(attr, '='); eq != -1 {
+				v := strings.Trim(attr[eq+1:], `"'`)
+				sel.attrs[strings.ToLower(attr[:eq])] = &v
+			} else {
+				sel.attrs[strings.ToLower(attr)] = nil
+			}
+			s = s[end+1:]
+		default:
+			return sel, fmt.Errorf("Invalid selector: %s", s)
+		}
+	}
+	return sel, nil
+}
+
+func (sel simpleSelector) matches(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	if len(sel.tag) > 0 && sel.tag != n.Data {
+		return false
+	}
+	if len(sel.id) > 0 && findAttr("id", n) != sel.id {
+		return false
+	}
+	classes := strings.Fields(findAttr("class", n))
+	for _, c := range sel.classes {
+		found := false
+		for _, x := range classes {
+			if x == c {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for attr, value := range sel.attrs {
+		if !hasAttr(attr, n) || (value != nil && findAttr(attr, n) != *value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSequence returns true if n matches the last selector of seq,
+// and its ancestors match the rest in order
+func matchSequence(seq []simpleSelector, n *html.Node) bool {
+	if !seq[len(seq)-1].matches(n) {
+		return false
+	}
+	seq = seq[:len(seq)-1]
+	for p := n.Parent; p != nil && len(seq) > 0; p = p.Parent {
+		if seq[len(seq)-1].matches(p) {
+			seq = seq[:len(seq)-1]
+		}
+	}
+	return len(seq) == 0
+}
+
+// Find returns the nodes under root matching the selector in document order
+func (s Selector) Find(root *html.Node) []*html.Node {
+	var ret []*html.Node
+	var itr func(*html.Node)
+	itr = func(n *html.Node) {
+		for _, seq := range s {
+			if matchSequence(seq, n) {
+				ret = append(ret, n)
+				break
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			itr(c)
+		}
+	}
+	itr(root)
+	return ret
+}
+
+// Text returns the text of the first node under root matching the
+// selector that has text, with whitespace collapsed
+func (s Selector) Text(root *html.Node) string {
+	for _, n := range s.Find(root) {
+		if t := strings.Join(strings.Fields(nodeText(n)), " "); len(t) > 0 {
+			return t
+		}
+	}
+	return ""
+}
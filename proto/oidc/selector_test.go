@@ -0,0 +1,54 @@
+package oidc
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+var selectorPage = `<html><body>
+<div id="kc-content">
+<div class="alert alert-error"><span class="icon"></span>
+<span class="kc-feedback-text">Invalid   username or password.</span></div>
+<p role="alert" class="empty"></p>
+</div>
+<span class="kc-feedback-text">Other</span>
+</body></html>`
+
+func TestSelector(t *testing.T) {
+	node, err := html.Parse(strings.NewReader(selectorPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		selector string
+		text     string
+		count    int
+	}{{"div.alert-error", "Invalid username or password.", 1},
+		{"#kc-content .kc-feedback-text", "Invalid username or password.", 1},
+		{".kc-feedback-text", "Invalid username or password.", 2},
+		{"div.alert.alert-error span.kc-feedback-text", "Invalid username or password.", 1},
+		{"[role=alert], span.kc-feedback-text", "Invalid username or password.", 3},
+		{"p[role='alert']", "", 1},
+		{"div#missing span", "", 0},
+		{"* .icon", "", 1}}
+	for _, x := range tests {
+		sel, err := ParseSelector(x.selector)
+		if err != nil {
+			t.Errorf("%s: %s", x.selector, err)
+			continue
+		}
+		if n := len(sel.Find(node)); n != x.count {
+			t.Errorf("%s: expected %d matches, got %d", x.selector, x.count, n)
+		}
+		if text := sel.Text(node); text != x.text {
+			t.Errorf("%s: wrong text: %s", x.selector, text)
+		}
+	}
+	for _, s := range []string{"", "div,", "div[role", "div>span"} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("Invalid selector accepted: %s", s)
+		}
+	}
+}
@@ -2,35 +2,127 @@ package oidc
 
 import (
 	"encoding/json"
-	"fmt"
 
 	"github.com/bserdar/took/proto"
-	log "github.com/sirupsen/logrus"
 )
 
 // ServerData contains the OIDC server information
 type ServerData struct {
+	Issuer                string `json:"issuer"`
 	AuthorizationEndpoint string `json:"authorization_endpoint"`
 	TokenEndpoint         string `json:"token_endpoint"`
 	IntrospectionEndpoint string `json:"token_introspection_endpoint"`
 	UserInfoEndpoint      string `json:"userinfo_endpoint"`
 	EndSessionEndpoint    string `json:"end_session_endpoint"`
 	JWKSUri               string `json:"jwks_uri"`
+
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	RevocationEndpoint          string `json:"revocation_endpoint"`
+
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+
+	MTLSEndpointAliases *MTLSEndpointAliases `json:"mtls_endpoint_aliases"`
 }
 
-// GetServerData retrieves server data from the auth server
-func GetServerData(url string) (ServerData, error) {
-	cfgUrl := combine(url, ".well-known/openid-configuration")
-	log.Debugf("Getting server info from %s", cfgUrl)
-	resp, err := proto.HTTPGet(cfgUrl)
-	if err != nil {
-		return ServerData{}, err
+// UnmarshalJSON reads the server metadata. The introspection
+// endpoint is read from the standard introspection_endpoint key, or
+// token_introspection_endpoint used by older Keycloak versions
+func (s *ServerData) UnmarshalJSON(data []byte) error {
+	type serverData ServerData
+	var d struct {
+		serverData
+		Introspection string `json:"introspection_endpoint"`
 	}
-	defer resp.Body.Close()
-	var d ServerData
-	err = json.NewDecoder(resp.Body).Decode(&d)
-	if err != nil {
-		err = fmt.Errorf("Cannot get SSO server information from %s: %s", cfgUrl, err.Error())
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
 	}
+	*s = ServerData(d.serverData)
+	s.IntrospectionEndpoint = wdef(d.Introspection, s.IntrospectionEndpoint)
+	return nil
+}
+
+// MTLSEndpointAliases are the endpoints to use with TLS client
+// authentication instead of the default endpoints (RFC 8705)
+type MTLSEndpointAliases struct {
+	TokenEndpoint               string `json:"token_endpoint"`
+	IntrospectionEndpoint       string `json:"introspection_endpoint"`
+	UserInfoEndpoint            string `json:"userinfo_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	RevocationEndpoint          string `json:"revocation_endpoint"`
+}
+
+// WithMTLSAliases returns a copy of the server data with the
+// endpoints replaced by their mTLS aliases
+func (s ServerData) WithMTLSAliases() ServerData {
+	if s.MTLSEndpointAliases == nil {
+		return s
+	}
+	a := s.MTLSEndpointAliases
+	s.TokenEndpoint = wdef(a.TokenEndpoint, s.TokenEndpoint)
+	s.IntrospectionEndpoint = wdef(a.IntrospectionEndpoint, s.IntrospectionEndpoint)
+	s.UserInfoEndpoint = wdef(a.UserInfoEndpoint, s.UserInfoEndpoint)
+	s.DeviceAuthorizationEndpoint = wdef(a.DeviceAuthorizationEndpoint, s.DeviceAuthorizationEndpoint)
+	s.RevocationEndpoint = wdef(a.RevocationEndpoint, s.RevocationEndpoint)
+	return s
+}
+
+// GetServerData retrieves server data from the auth server, without
+// using the discovery cache
+func GetServerData(url string) (ServerData, error) {
+	d, _, err := fetchServerData(url, 0)
 	return d, err
 }
+
+// getServerData retrieves the server data for the configuration,
+// using the discovery cache, unless discovery is disabled. Endpoints
+// given in the configuration override the discovered ones. If the
+// configuration uses a client certificate, the mTLS endpoint aliases
+// are used
+func getServerData(config Config) (ServerData, error) {
+	var d ServerData
+	if !config.NoDiscovery {
+		ttl, err := discoveryTTL(config)
+		if err != nil {
+			return ServerData{}, err
+		}
+		d, err = GetCachedServerData(config.URL, ttl)
+		if err != nil {
+			return d, err
+		}
+		if len(config.ClientCert) > 0 {
+			d = d.WithMTLSAliases()
+		}
+	}
+	endpoint := func(api, discovered string) string {
+		if len(api) == 0 {
+			return discovered
+		}
+		return combine(config.URL, api)
+	}
+	d.AuthorizationEndpoint = endpoint(config.AuthAPI, d.AuthorizationEndpoint)
+	d.TokenEndpoint = endpoint(config.TokenAPI, d.TokenEndpoint)
+	d.IntrospectionEndpoint = endpoint(config.IntrospectionAPI, d.IntrospectionEndpoint)
+	d.RevocationEndpoint = endpoint(config.RevocationAPI, d.RevocationEndpoint)
+	d.DeviceAuthorizationEndpoint = endpoint(config.DeviceAPI, d.DeviceAuthorizationEndpoint)
+	d.UserInfoEndpoint = endpoint(config.UserInfoAPI, d.UserInfoEndpoint)
+	d.EndSessionEndpoint = endpoint(config.EndSessionAPI, d.EndSessionEndpoint)
+	d.JWKSUri = endpoint(config.JWKSAPI, d.JWKSUri)
+	return d, nil
+}
+
+// setupTLS loads the client certificate and the CA bundle of the configuration
+func setupTLS(config Config) error {
+	proto.ClientCertificates = nil
+	proto.RootCAs = nil
+	if len(config.ClientCert) > 0 {
+		if err := proto.LoadClientCertificate(config.ClientCert, config.ClientCertKey); err != nil {
+			return err
+		}
+	}
+	if len(config.CABundle) > 0 {
+		if err := proto.LoadCABundle(config.CABundle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package oidc
+
+import (
+	"net/url"
+
+	"golang.org/x/oauth2"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/bserdar/took/proto"
+)
+
+// Target is the resource (RFC 8707) and audience requested for a token
+type Target struct {
+	Resource string
+	Audience string
+}
+
+// requestTarget returns the target of the token request, using the
+// configuration defaults for the values not in the request
+func requestTarget(config Config, request proto.TokenRequest) Target {
+	return Target{Resource: wdef(request.Resource, config.Resource),
+		Audience: wdef(request.Audience, config.Audience)}
+}
+
+// setValues adds the target to the request values
+func (t Target) setValues(values url.Values) {
+	if len(t.Resource) > 0 {
+		values.Set("resource", t.Resource)
+	}
+	if len(t.Audience) > 0 {
+		values.Set("audience", t.Audience)
+	}
+}
+
+// authOptions returns the authorization request parameters for the target
+func (t Target) authOptions() []oauth2.AuthCodeOption {
+	var ret []oauth2.AuthCodeOption
+	if len(t.Resource) > 0 {
+		ret = append(ret, oauth2.SetAuthURLParam("resource", t.Resource))
+	}
+	if len(t.Audience) > 0 {
+		ret = append(ret, oauth2.SetAuthURLParam("audience", t.Audience))
+	}
+	return ret
+}
+
+// target returns the target the token was requested for
+func (t TokenData) target() Target {
+	return Target{Resource: t.Resource, Audience: t.Audience}
+}
+
+// audienceMatches returns false if the token is a JWT whose aud
+// claim contains neither the requested audience nor the resource
+func (t TokenData) audienceMatches() bool {
+	if len(t.Audience) == 0 && len(t.Resource) == 0 {
+		return true
+	}
+	tok, err := jwt.ParseSigned(t.AccessToken)
+	if err != nil {
+		return true
+	}
+	var c jwt.Claims
+	if tok.UnsafeClaimsWithoutVerification(&c) != nil {
+		return true
+	}
+	// Servers may use either the resource or the audience as aud
+	return len(t.Audience) > 0 && c.Audience.Contains(t.Audience) ||
+		len(t.Resource) > 0 && c.Audience.Contains(t.Resource)
+}
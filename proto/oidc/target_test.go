@@ -0,0 +1,84 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/bserdar/took/cfg"
+	"github.com/bserdar/took/proto"
+)
+
+func TestAudienceMatches(t *testing.T) {
+	ks := newTestKeyServer(t)
+	defer ks.server.Close()
+	access := ks.sign(t, jwt.Claims{Audience: jwt.Audience{"svc", "https://api"}})
+	for _, x := range []struct {
+		tok      TokenData
+		expected bool
+	}{
+		{TokenData{AccessToken: access}, true},
+		{TokenData{AccessToken: access, Audience: "svc"}, true},
+		{TokenData{AccessToken: access, Audience: "svc", Resource: "https://api"}, true},
+		{TokenData{AccessToken: access, Audience: "other"}, false},
+		{TokenData{AccessToken: access, Resource: "https://other"}, false},
+		{TokenData{AccessToken: access, Audience: "svc", Resource: "https://other"}, true},
+		{TokenData{AccessToken: access, Audience: "other", Resource: "https://api"}, true},
+		{TokenData{AccessToken: access, Audience: "other", Resource: "https://other"}, false},
+		{TokenData{AccessToken: "opaque", Audience: "other"}, true},
+	} {
+		if x.tok.audienceMatches() != x.expected {
+			t.Errorf("Wrong result for %s %s", x.tok.Audience, x.tok.Resource)
+		}
+	}
+}
+
+func TestGetToken_Target(t *testing.T) {
+	var requests []string
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"token_endpoint":"%s/token","token_introspection_endpoint":"%s/verify"}`, server.URL, server.URL)
+	})
+	mux.HandleFunc("/verify", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"active":true}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		target := req.Form.Get("resource") + "|" + req.Form.Get("audience")
+		requests = append(requests, target)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"%s","token_type":"bearer","expires_in":300}`, target)
+	})
+
+	p := Protocol{}
+	tr := true
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: server.URL, PasswordGrant: &tr, Audience: "default"},
+		ClientID: "id"}
+	cfg.AskPasswordWithPrompt = func(s string) string { return "pwd" }
+
+	ret, _, err := p.GetToken(proto.TokenRequest{Username: "user"})
+	if err != nil || ret != "|default" {
+		t.Fatalf("Wrong token: %s %v", ret, err)
+	}
+	ret, _, _ = p.GetToken(proto.TokenRequest{Username: "user", Resource: "https://api", Audience: "svc"})
+	if ret != "https://api|svc" {
+		t.Errorf("Wrong token: %s", ret)
+	}
+	// Both are cached
+	ret, _, _ = p.GetToken(proto.TokenRequest{Username: "user"})
+	if ret != "|default" || len(requests) != 2 {
+		t.Errorf("Wrong token: %s %v", ret, requests)
+	}
+	ret, _, _ = p.GetToken(proto.TokenRequest{Username: "user", Resource: "https://api", Audience: "svc"})
+	if ret != "https://api|svc" || len(requests) != 2 {
+		t.Errorf("Wrong token: %s %v", ret, requests)
+	}
+	if len(p.Tokens.Tokens) != 2 {
+		t.Errorf("Wrong tokens: %+v", p.Tokens.Tokens)
+	}
+}
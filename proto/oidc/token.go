@@ -0,0 +1,114 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// TokenError is the error response returned from the token endpoint
+type TokenError struct {
+	Status      string `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e TokenError) Error() string {
+	if len(e.Code) == 0 {
+		return fmt.Sprintf("Token request failed: %s", e.Status)
+	}
+	if len(e.Description) == 0 {
+		return fmt.Sprintf("Token request failed: %s", e.Code)
+	}
+	return fmt.Sprintf("Token request failed: %s: %s", e.Code, e.Description)
+}
+
+// tokenResponse is the successful response of the token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	// Some servers send these as strings
+	ExpiresIn        json.Number `json:"expires_in"`
+	RefreshExpiresIn json.Number `json:"refresh_expires_in"`
+	Scope            string      `json:"scope"`
+	IDToken          string      `json:"id_token"`
+}
+
+// Token returns the oauth2 token for the response received at time
+// now. The refresh token expiration, scope, and ID token are stored
+// as token extras
+func (r tokenResponse) Token(now time.Time) oauth2.Token {
+	t := oauth2.Token{AccessToken: r.AccessToken,
+		TokenType:    r.TokenType,
+		RefreshToken: r.RefreshToken}
+	if n, err := r.ExpiresIn.Int64(); err == nil && n > 0 {
+		t.Expiry = now.Add(time.Duration(n) * time.Second)
+	}
+	extra := map[string]interface{}{"scope": r.Scope, "id_token": r.IDToken}
+	if n, err := r.RefreshExpiresIn.Int64(); err == nil && n > 0 {
+		extra["refresh_expires_in"] = n
+	}
+	return *t.WithExtra(extra)
+}
+
+// postTokenRequest posts the values to the token endpoint with client
+// authentication, and parses the response
+func postTokenRequest(auth ClientAuth, tokenURL string, values url.Values) (oauth2.Token, error) {
+	resp, err := auth.PostForm(tokenURL, values)
+	if err != nil {
+		log.Debugf("Token request returns: %s", err)
+		return oauth2.Token{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Debugf("Token request returns: %s", resp.Status)
+		tokenErr := TokenError{}
+		json.NewDecoder(resp.Body).Decode(&tokenErr)
+		tokenErr.Status = resp.Status
+		return oauth2.Token{}, tokenErr
+	}
+	var d tokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&d)
+	if err != nil {
+		return oauth2.Token{}, err
+	}
+	log.Debugf("Tokens: %v", d)
+	return d.Token(time.Now()), nil
+}
+
+// AuthCodeToken exchanges the authorization code for tokens. If
+// verifier is nonempty, it is sent as the PKCE code verifier
+func AuthCodeToken(auth ClientAuth, code, redirectURL, verifier string, target Target, tokenURL string) (oauth2.Token, error) {
+	values := url.Values{}
+	values.Set("grant_type", "authorization_code")
+	values.Set("code", code)
+	if len(redirectURL) > 0 {
+		values.Set("redirect_uri", redirectURL)
+	}
+	if len(verifier) > 0 {
+		values.Set("code_verifier", verifier)
+	}
+	target.setValues(values)
+	log.Debugf("Authorization code exchange %s", tokenURL)
+	return postTokenRequest(auth, tokenURL, values)
+}
+
+// PasswordToken gets tokens using the resource owner password credentials grant
+func PasswordToken(auth ClientAuth, userName, password string, scopes []string, target Target, tokenURL string) (oauth2.Token, error) {
+	values := url.Values{}
+	values.Set("grant_type", "password")
+	values.Set("username", userName)
+	values.Set("password", password)
+	if len(scopes) > 0 {
+		values.Set("scope", strings.Join(scopes, " "))
+	}
+	target.setValues(values)
+	log.Debugf("Password grant %s", tokenURL)
+	return postTokenRequest(auth, tokenURL, values)
+}
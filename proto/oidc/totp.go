@@ -0,0 +1,60 @@
+package oidc
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FieldKindTOTP is the kind of a form field filled with a time-based
+// one-time password
+const FieldKindTOTP = "totp"
+
+// totpStep is the TOTP time step
+const totpStep = 30 * time.Second
+
+// totpDigits is the number of digits of a TOTP code
+const totpDigits = 6
+
+// decodeTOTPSeed decodes a base32 seed. Spaces and padding are
+// optional, and the seed is case insensitive
+func decodeTOTPSeed(seed string) ([]byte, error) {
+	seed = strings.ToUpper(strings.Join(strings.Fields(seed), ""))
+	seed = strings.TrimRight(seed, "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(seed)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid TOTP seed: %s", err)
+	}
+	return key, nil
+}
+
+// hotp returns the HOTP value (RFC 4226) of the key for the counter
+func hotp(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// TOTP returns the time-based one-time password (RFC 6238) for the
+// base32 encoded seed at time t, using HMAC-SHA1, 30 second steps
+// and 6 digits
+func TOTP(seed string, t time.Time) (string, error) {
+	key, err := decodeTOTPSeed(seed)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(t.Unix()/int64(totpStep/time.Second)), totpDigits), nil
+}
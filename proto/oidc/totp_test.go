@@ -0,0 +1,75 @@
+package oidc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"github.com/bserdar/took/cfg"
+)
+
+// totpTestSeed is the base32 encoding of the RFC 6238 SHA1 test key "12345678901234567890"
+const totpTestSeed = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238, Appendix B
+	vectors := []struct {
+		time int64
+		code string
+	}{{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"}}
+	key, err := decodeTOTPSeed(totpTestSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vectors {
+		if c := hotp(key, uint64(v.time/30), 8); c != v.code {
+			t.Errorf("Wrong code at %d: %s, expected %s", v.time, c, v.code)
+		}
+		c, err := TOTP(strings.ToLower(totpTestSeed), time.Unix(v.time, 0))
+		if err != nil {
+			t.Error(err)
+		}
+		if c != v.code[2:] {
+			t.Errorf("Wrong TOTP at %d: %s, expected %s", v.time, c, v.code[2:])
+		}
+	}
+	if _, err := TOTP("not base32!", time.Now()); err == nil {
+		t.Errorf("Invalid seed accepted")
+	}
+}
+
+func TestFillForm_TOTP(t *testing.T) {
+	page := `<html><body><form action="otp">
+<input type="text" name="otp"/>
+</form></body></html>`
+	node, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := HTMLFormConfig{Fields: []FieldConfig{{Input: "otp", Kind: FieldKindTOTP, Seed: totpTestSeed}}}
+	_, values, err := FillForm(config, node, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values.Get("otp")) != 6 {
+		t.Errorf("Wrong code: %v", values)
+	}
+
+	// No seed, ask for the code
+	cfg.Ask = func(prompt string) string { return "123456" }
+	config.Fields[0].Seed = ""
+	_, values, err = FillForm(config, node, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Get("otp") != "123456" {
+		t.Errorf("Wrong code: %v", values)
+	}
+}
@@ -0,0 +1,71 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bserdar/took/proto"
+)
+
+// UserInfo gets a token, and returns the claims from the userinfo endpoint
+func (p *Protocol) UserInfo(request proto.TokenRequest) (map[string]interface{}, interface{}, error) {
+	request.Out = proto.OutputToken
+	request.IDToken = false
+	accessToken, data, err := p.GetToken(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverData, err := getServerData(p.GetConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+	claims, err := GetUserInfo(accessToken, serverData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return claims, data, nil
+}
+
+// GetUserInfo calls the userinfo endpoint with the access token, and
+// returns the claims. Signed userinfo responses are verified using the
+// server keys
+func GetUserInfo(accessToken string, serverData ServerData) (map[string]interface{}, error) {
+	if len(serverData.UserInfoEndpoint) == 0 {
+		return nil, fmt.Errorf("Server does not have a userinfo endpoint")
+	}
+	req, err := http.NewRequest(http.MethodGet, serverData.UserInfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	log.Debugf("Getting user info from %s", serverData.UserInfoEndpoint)
+	resp, err := proto.GetHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cannot get user info: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/jwt" {
+		if _, err := VerifyJWT(string(body), serverData, &claims); err != nil {
+			return nil, fmt.Errorf("Cannot verify user info: %s", err)
+		}
+		return claims, nil
+	}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("Cannot parse user info: %s", err)
+	}
+	return claims, nil
+}
@@ -0,0 +1,68 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/bserdar/took/cfg"
+	"github.com/bserdar/took/proto"
+)
+
+func TestUserInfo(t *testing.T) {
+	ks := newTestKeyServer(t)
+	defer ks.server.Close()
+	mux := ks.server.Config.Handler.(*http.ServeMux)
+	signed := false
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"issuer":"%s","token_endpoint":"%s/token","userinfo_endpoint":"%s/userinfo","jwks_uri":"%s/keys"}`, ks.server.URL, ks.server.URL, ks.server.URL, ks.server.URL)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"a","token_type":"bearer"}`))
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer a" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if signed {
+			w.Header().Set("Content-Type", "application/jwt")
+			w.Write([]byte(ks.sign(t, map[string]interface{}{"sub": "signed", "groups": []string{"a", "b"}})))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"sub":"user","groups":["a","b"]}`))
+	})
+
+	p := Protocol{}
+	tr := true
+	p.Cfg = Config{ServerProfile: ServerProfile{URL: ks.server.URL, PasswordGrant: &tr},
+		ClientID: "id"}
+	cfg.AskPasswordWithPrompt = func(s string) string { return "pwd" }
+
+	claims, data, err := p.UserInfo(proto.TokenRequest{Username: "user"})
+	if err != nil {
+		t.Fatalf("Cannot get user info: %v", err)
+	}
+	if claims["sub"] != "user" || len(claims["groups"].([]interface{})) != 2 {
+		t.Errorf("Wrong claims: %v", claims)
+	}
+	if data.(Data).Tokens[0].AccessToken != "a" {
+		t.Errorf("Token data is not returned")
+	}
+
+	signed = true
+	claims, _, err = p.UserInfo(proto.TokenRequest{Username: "user"})
+	if err != nil {
+		t.Fatalf("Cannot get signed user info: %v", err)
+	}
+	if claims["sub"] != "signed" {
+		t.Errorf("Wrong claims: %v", claims)
+	}
+
+	// Signed user info cannot be verified without the server keys
+	if _, err := GetUserInfo("a", ServerData{UserInfoEndpoint: ks.server.URL + "/userinfo"}); err == nil {
+		t.Errorf("Expected error")
+	}
+}
@@ -3,23 +3,87 @@ package oidc
 import (
 	"encoding/json"
 	"fmt"
-	"net/http"
-	"strings"
+	"net/url"
+	"time"
 
 	log "github.com/sirupsen/logrus"
-
-	"github.com/bserdar/took/proto"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
 )
 
-// Validate checks if a token is valid
-func (p *Protocol) Validate(accessToken string, serverData ServerData) bool {
-	cli := proto.GetHTTPClient()
-	req, _ := http.NewRequest(http.MethodPost, serverData.IntrospectionEndpoint,
-		strings.NewReader(fmt.Sprintf("token=%s", accessToken)))
-	req.SetBasicAuth(p.Cfg.ClientID, p.Cfg.ClientSecret)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+// accessTokenClaims are the claims of a JWT access token used to
+// check if the token was issued to this client
+type accessTokenClaims struct {
+	jwt.Claims
+	AuthorizedParty string `json:"azp,omitempty"`
+	ClientID        string `json:"client_id,omitempty"`
+	CID             string `json:"cid,omitempty"`
+}
+
+// Validate checks if a token is valid. JWT access tokens are
+// validated locally using the server keys. Opaque tokens, all tokens
+// if the server keys are not known, or if the configuration requires
+// it, are validated using the introspection endpoint. If the server
+// does not have an introspection endpoint, these tokens are valid
+// until their stored expiration
+func (p *Protocol) Validate(tok TokenData, serverData ServerData) bool {
+	config := p.GetConfig()
+	accessToken := tok.AccessToken
+	if !config.Introspect && len(serverData.JWKSUri) > 0 {
+		err := ValidateJWT(accessToken, serverData, config.ClientID, time.Now())
+		if err == nil {
+			return true
+		}
+		if err != errNotJWT {
+			log.Debugf("Token is not valid: %s", err)
+			return false
+		}
+		log.Debug("Token is not a JWT, using introspection")
+	}
+	if !config.Introspect && len(serverData.IntrospectionEndpoint) == 0 {
+		if tok.Expiry == 0 {
+			log.Debug("There is no introspection endpoint, and token expiration is not known")
+			return false
+		}
+		log.Debug("There is no introspection endpoint, using token expiration")
+		return !tok.Expired(time.Now())
+	}
+	return p.Introspect(accessToken, serverData)
+}
+
+// ValidateJWT validates a JWT access token locally. It verifies the
+// signature, exp and nbf allowing for clock skew, iss, and that the
+// token was issued to the client, either because aud contains the
+// client id, or because the authorized party is the client
+func ValidateJWT(accessToken string, serverData ServerData, clientID string, now time.Time) error {
+	var claims accessTokenClaims
+	_, err := VerifyJWT(accessToken, serverData, &claims)
+	if err != nil {
+		return err
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Issuer: serverData.Issuer, Time: now}, jwt.DefaultLeeway); err != nil {
+		return err
+	}
+	if claims.Audience.Contains(clientID) {
+		return nil
+	}
+	for _, x := range []string{claims.AuthorizedParty, claims.ClientID, claims.CID} {
+		if x == clientID {
+			return nil
+		}
+	}
+	return fmt.Errorf("Token was not issued to %s", clientID)
+}
+
+// Introspect checks if a token is active using the introspection endpoint
+func (p *Protocol) Introspect(accessToken string, serverData ServerData) bool {
+	if len(serverData.IntrospectionEndpoint) == 0 {
+		log.Debug("There is no introspection endpoint")
+		return false
+	}
+	values := url.Values{}
+	values.Set("token", accessToken)
 	log.Debugf("Sending introspection request to %s", serverData.IntrospectionEndpoint)
-	response, err := cli.Do(req)
+	response, err := p.clientAuth(serverData).PostForm(serverData.IntrospectionEndpoint, values)
 	if err != nil {
 		log.Debugf("Introspection error: %s", err.Error())
 	} else {
@@ -0,0 +1,192 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+type testKeyServer struct {
+	server *httptest.Server
+	// key signs tokens, public is published
+	key          *rsa.PrivateKey
+	public       *rsa.PublicKey
+	kid          string
+	introspected bool
+	jwksRequests int
+	activeOpaque bool
+}
+
+func newTestKeyServer(t *testing.T) *testKeyServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := &testKeyServer{key: key, public: &key.PublicKey, kid: "k1"}
+	mux := http.NewServeMux()
+	ks.server = httptest.NewServer(mux)
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, req *http.Request) {
+		ks.jwksRequests++
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: ks.public, KeyID: ks.kid, Algorithm: "RS256", Use: "sig"}}})
+	})
+	mux.HandleFunc("/verify", func(w http.ResponseWriter, req *http.Request) {
+		ks.introspected = true
+		fmt.Fprintf(w, `{"active":%v}`, ks.activeOpaque)
+	})
+	return ks
+}
+
+func (ks *testKeyServer) serverData() ServerData {
+	return ServerData{Issuer: ks.server.URL, JWKSUri: ks.server.URL + "/keys", IntrospectionEndpoint: ks.server.URL + "/verify"}
+}
+
+func (ks *testKeyServer) sign(t *testing.T, claims interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: ks.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", ks.kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestValidateJWT(t *testing.T) {
+	ks := newTestKeyServer(t)
+	defer ks.server.Close()
+	now := time.Now()
+	claims := func(iss string, exp time.Time, aud ...string) accessTokenClaims {
+		return accessTokenClaims{Claims: jwt.Claims{Issuer: iss,
+			Audience: aud,
+			IssuedAt: jwt.NewNumericDate(now.Add(-time.Minute)),
+			Expiry:   jwt.NewNumericDate(exp)}}
+	}
+
+	p := Protocol{}
+	p.Cfg = Config{ClientID: "id"}
+
+	if !p.Validate(TokenData{AccessToken: ks.sign(t, claims(ks.server.URL, now.Add(time.Hour), "id"))}, ks.serverData()) {
+		t.Errorf("Token should be valid")
+	}
+	if p.Validate(TokenData{AccessToken: ks.sign(t, claims(ks.server.URL, now.Add(-2*jwt.DefaultLeeway), "id"))}, ks.serverData()) {
+		t.Errorf("Token is expired")
+	}
+	// Small clock skew is tolerated
+	skewed := claims(ks.server.URL, now.Add(time.Hour), "id")
+	skewed.NotBefore = jwt.NewNumericDate(now.Add(30 * time.Second))
+	if !p.Validate(TokenData{AccessToken: ks.sign(t, skewed)}, ks.serverData()) {
+		t.Errorf("Token should be valid with clock skew")
+	}
+	if p.Validate(TokenData{AccessToken: ks.sign(t, claims("http://other", now.Add(time.Hour), "id"))}, ks.serverData()) {
+		t.Errorf("Wrong issuer")
+	}
+	if p.Validate(TokenData{AccessToken: ks.sign(t, claims(ks.server.URL, now.Add(time.Hour), "other"))}, ks.serverData()) {
+		t.Errorf("Wrong audience")
+	}
+	azp := claims(ks.server.URL, now.Add(time.Hour), "account")
+	azp.AuthorizedParty = "id"
+	if !p.Validate(TokenData{AccessToken: ks.sign(t, azp)}, ks.serverData()) {
+		t.Errorf("Token should be valid for authorized party")
+	}
+	if ks.introspected {
+		t.Errorf("JWTs should not be introspected")
+	}
+
+	// Key rotation: the new key is retrieved
+	ks.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ks.public = &ks.key.PublicKey
+	ks.kid = "k2"
+	requests := ks.jwksRequests
+	if !p.Validate(TokenData{AccessToken: ks.sign(t, claims(ks.server.URL, now.Add(time.Hour), "id"))}, ks.serverData()) {
+		t.Errorf("Token with rotated key should be valid")
+	}
+	if ks.jwksRequests != requests+1 {
+		t.Errorf("Keys are not refreshed")
+	}
+
+	// Opaque tokens are introspected
+	ks.activeOpaque = true
+	if !p.Validate(TokenData{AccessToken: "opaque"}, ks.serverData()) || !ks.introspected {
+		t.Errorf("Opaque token should be introspected")
+	}
+
+	// Signed with a key that is not published
+	ks.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	if p.Validate(TokenData{AccessToken: ks.sign(t, claims(ks.server.URL, now.Add(time.Hour), "id"))}, ks.serverData()) {
+		t.Errorf("Forged token should not be valid")
+	}
+}
+
+func TestValidate_NoIntrospection(t *testing.T) {
+	ks := newTestKeyServer(t)
+	defer ks.server.Close()
+	serverData := ks.serverData()
+	serverData.IntrospectionEndpoint = ""
+	p := Protocol{}
+	p.Cfg = Config{ClientID: "id"}
+	now := time.Now()
+
+	if !p.Validate(TokenData{AccessToken: "opaque", Expiry: now.Add(time.Hour).Unix()}, serverData) {
+		t.Errorf("Opaque token should be valid until its expiration")
+	}
+	if p.Validate(TokenData{AccessToken: "opaque", Expiry: now.Add(-time.Minute).Unix()}, serverData) {
+		t.Errorf("Expired opaque token should not be valid")
+	}
+	if p.Validate(TokenData{AccessToken: "opaque"}, serverData) {
+		t.Errorf("Opaque token without expiration should not be valid")
+	}
+	p.Cfg.Introspect = true
+	if p.Validate(TokenData{AccessToken: "opaque", Expiry: now.Add(time.Hour).Unix()}, serverData) {
+		t.Errorf("Token should not be valid if introspection is required")
+	}
+	if ks.introspected {
+		t.Errorf("Token should not be introspected")
+	}
+}
+
+func TestGetJWKS_Cache(t *testing.T) {
+	DiscoveryCacheDir = t.TempDir()
+	defer func() { DiscoveryCacheDir = "" }()
+	ks := newTestKeyServer(t)
+	defer ks.server.Close()
+	uri := ks.serverData().JWKSUri
+
+	if _, err := GetJWKS(uri, false); err != nil {
+		t.Fatal(err)
+	}
+	// A new run uses the key set stored on disk
+	delete(jwksCache, uri)
+	keys, err := GetJWKS(uri, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.jwksRequests != 1 || len(keys.Key("k1")) != 1 {
+		t.Errorf("Cached key set is not used: %d", ks.jwksRequests)
+	}
+
+	// Unknown kid retrieves the key set again, and updates the cache
+	ks.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ks.public = &ks.key.PublicKey
+	ks.kid = "k2"
+	delete(jwksCache, uri)
+	p := Protocol{}
+	p.Cfg = Config{ClientID: "id"}
+	claims := jwt.Claims{Issuer: ks.server.URL, Audience: jwt.Audience{"id"}, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	if !p.Validate(TokenData{AccessToken: ks.sign(t, claims)}, ks.serverData()) {
+		t.Errorf("Token with rotated key should be valid")
+	}
+	delete(jwksCache, uri)
+	if keys, _ := GetJWKS(uri, false); ks.jwksRequests != 2 || len(keys.Key("k2")) != 1 {
+		t.Errorf("Cache is not updated: %d", ks.jwksRequests)
+	}
+}
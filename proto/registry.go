@@ -1,6 +1,9 @@
 package proto
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/bserdar/took/cfg"
 
 	"github.com/spf13/cobra"
@@ -31,6 +34,16 @@ type TokenRequest struct {
 	Out      OutputOption
 	Username string
 	Password string
+	// MinValid is the minimum duration the returned token must remain valid
+	MinValid time.Duration
+	// IDToken returns the ID token instead of the access token
+	IDToken bool
+	// Scopes, if nonempty, are requested instead of the configured scopes
+	Scopes []string
+	// Resource and Audience, if nonempty, are the target service of
+	// the token, instead of the configured defaults
+	Resource string
+	Audience string
 }
 
 // Protocol defines a protocol
@@ -54,6 +67,31 @@ type Protocol interface {
 	InitSetupWizard(name string, profileName string, profile cfg.Profile) ([]SetupStep, *cobra.Command)
 }
 
+// UserInfoProtocol is implemented by protocols that can retrieve
+// the claims of the authenticated user
+type UserInfoProtocol interface {
+	// UserInfo gets a token as described in the request, and returns
+	// the user claims and the new copy of the data block
+	UserInfo(TokenRequest) (map[string]interface{}, interface{}, error)
+}
+
+// LogoutRequest describes which tokens to invalidate
+type LogoutRequest struct {
+	// Username is the user to log out. If empty, the last user is used
+	Username string
+	// All logs out all users
+	All bool
+	// EndSession also ends the user session at the server
+	EndSession bool
+}
+
+// LogoutProtocol is implemented by protocols that can invalidate tokens
+type LogoutProtocol interface {
+	// Logout revokes the tokens described in the request, and
+	// returns the new copy of the data block without them
+	Logout(LogoutRequest) (interface{}, error)
+}
+
 var protocols = make(map[string]func() Protocol)
 
 // Register registers a protocol
@@ -80,3 +118,88 @@ func ProtocolNames() []string {
 	}
 	return ret
 }
+
+// GetRemoteProtocol looks up the remote configuration name in the
+// user and common configurations, and returns a protocol instance
+// initialized with it, and the user remote configuration
+func GetRemoteProtocol(name string) (Protocol, cfg.Remote, error) {
+	userRemote, uok := cfg.UserCfg.Remotes[name]
+	commonRemote, cok := cfg.CommonCfg.Remotes[name]
+	if !uok && !cok {
+		return nil, cfg.Remote{}, fmt.Errorf("Cannot find %s", name)
+	}
+	t := userRemote.Type
+	if len(t) == 0 {
+		t = commonRemote.Type
+	}
+	if len(t) == 0 {
+		return nil, cfg.Remote{}, fmt.Errorf("Invalid configuration: no type for %s", name)
+	}
+	protocol := Get(t)
+	if protocol == nil {
+		return nil, cfg.Remote{}, fmt.Errorf("Cannot find protocol %s", t)
+	}
+	protocol.SetCfg(userRemote, commonRemote)
+	return protocol, userRemote, nil
+}
+
+// GetRemoteToken gets a token for the named remote configuration,
+// and stores the new token data in the user configuration. The
+// caller is responsible for writing the user configuration
+func GetRemoteToken(name string, request TokenRequest) (string, error) {
+	protocol, userRemote, err := GetRemoteProtocol(name)
+	if err != nil {
+		return "", err
+	}
+	s, data, err := protocol.GetToken(request)
+	if err != nil {
+		return "", err
+	}
+	cfg.UserCfg.Remotes[name] = cfg.Remote{Type: userRemote.Type, Configuration: userRemote.Configuration,
+		Data: data}
+	return s, nil
+}
+
+// GetRemoteUserInfo returns the user claims for the named remote
+// configuration, and stores the new token data in the user
+// configuration. The caller is responsible for writing the user
+// configuration
+func GetRemoteUserInfo(name string, request TokenRequest) (map[string]interface{}, error) {
+	protocol, userRemote, err := GetRemoteProtocol(name)
+	if err != nil {
+		return nil, err
+	}
+	uip, ok := protocol.(UserInfoProtocol)
+	if !ok {
+		return nil, fmt.Errorf("%s does not support user info", userRemote.Type)
+	}
+	claims, data, err := uip.UserInfo(request)
+	if err != nil {
+		return nil, err
+	}
+	cfg.UserCfg.Remotes[name] = cfg.Remote{Type: userRemote.Type, Configuration: userRemote.Configuration,
+		Data: data}
+	return claims, nil
+}
+
+// LogoutRemote invalidates the tokens of the named remote
+// configuration, and stores the remaining token data in the user
+// configuration. The caller is responsible for writing the user
+// configuration
+func LogoutRemote(name string, request LogoutRequest) error {
+	protocol, userRemote, err := GetRemoteProtocol(name)
+	if err != nil {
+		return err
+	}
+	lp, ok := protocol.(LogoutProtocol)
+	if !ok {
+		return fmt.Errorf("%s does not support logout", userRemote.Type)
+	}
+	data, err := lp.Logout(request)
+	if err != nil {
+		return err
+	}
+	cfg.UserCfg.Remotes[name] = cfg.Remote{Type: userRemote.Type, Configuration: userRemote.Configuration,
+		Data: data}
+	return nil
+}